@@ -1,116 +1,408 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"fmt"
 	"github.com/juju/errors"
 	"github.com/obgnail/shadowsocks-toy/cipher"
 	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/dns"
 	"github.com/obgnail/shadowsocks-toy/logger"
 	"github.com/obgnail/shadowsocks-toy/ruleset"
+	"github.com/obgnail/shadowsocks-toy/upstream"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	defaultDialTimeout      = 10 * time.Second
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultIdleTimeout      = 5 * time.Minute
+	defaultUDPTimeout       = time.Minute
+)
+
+var errRejected = errors.New("rejected by ruleset")
+
 type Client struct {
-	ruleset    ruleset.Ruleset
-	cipher     cipher.Cipher
-	localAddr  *net.TCPAddr
-	serverAddr *net.TCPAddr
+	ruleset   ruleset.Ruleset
+	localAddr *net.TCPAddr
+	groups    map[string]*upstream.Group
+	proxy     *upstream.Group
+
+	// DIRECT 时连接目标使用的 Dialer, 透明代理的 UDP 也使用它, 为 nil 时直接连接
+	Dialer      dialer.Dialer
+	DialTimeout time.Duration
+	// 规则匹配和 DIRECT 时解析域名使用的 Resolver, 为 nil 时使用系统解析器
+	Resolver dns.Resolver
+	// 本地 dns 服务器, 为 nil 时不启动, 见 StartDNS
+	DNS *DNSConfig
+
+	dnsMu      sync.Mutex
+	dnsStarted bool
+	fakeIP     atomic.Pointer[dns.FakeIP]
+
+	healthOnce sync.Once
+
+	// 本地代理的认证, HTTPUsername 为空时不认证. HTTP 代理使用 Basic 认证, socks5 使用用户名/密码认证,
+	// 设置后拒绝没有认证方式的 socks4
+	HTTPUsername string
+	HTTPPassword string
+
+	// 本地 socks5 握手的超时时间
+	HandshakeTimeout time.Duration
+	// 隧道空闲超过 IdleTimeout 时关闭, 任意方向有数据时重新计时
+	IdleTimeout time.Duration
+	// 隧道的最长存活时间, 0 表示不限制
+	MaxSessionDuration time.Duration
+	// 透明代理的 UDP 会话空闲超过 UDPTimeout 时关闭
+	UDPTimeout time.Duration
+
+	acceptor connection.Acceptor
 }
 
 func New(listenAddr, remoteAddr string, c cipher.Cipher, r ruleset.Ruleset) (*Client, error) {
-	if c == nil {
-		c = &cipher.NopCipher{}
+	u, err := upstream.New(remoteAddr, remoteAddr, c)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithUpstreams(listenAddr, []*upstream.Upstream{u}, r)
+}
+
+// NewWithUpstreams 使用多个 Server, 优先使用排在前面的可用 Server, 连接失败时自动切换
+func NewWithUpstreams(listenAddr string, upstreams []*upstream.Upstream, r ruleset.Ruleset) (*Client, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream")
+	}
+	return NewWithGroups(listenAddr, r, upstream.NewGroup(ruleset.TargetProxy, upstreams...))
+}
+
+// NewWithGroups 使用多个 Server 组, ruleset 返回的出站为组名时使用对应的组.
+// 出站为 PROXY 时使用名为 PROXY 的组, 没有时使用第一个组
+func NewWithGroups(listenAddr string, r ruleset.Ruleset, groups ...*upstream.Group) (*Client, error) {
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no upstream group")
 	}
 	if r == nil {
 		r = &ruleset.Global{}
 	}
 
-	lAddr, err := net.ResolveTCPAddr("tcp4", listenAddr)
-	if err != nil {
-		return nil, err
+	c := &Client{
+		groups:           make(map[string]*upstream.Group, len(groups)),
+		ruleset:          r,
+		DialTimeout:      defaultDialTimeout,
+		HandshakeTimeout: defaultHandshakeTimeout,
+		IdleTimeout:      defaultIdleTimeout,
+		UDPTimeout:       defaultUDPTimeout,
 	}
-	rAddr, err := net.ResolveTCPAddr("tcp4", remoteAddr)
-	if err != nil {
-		return nil, err
+	// listenAddr 为空时只能使用 Serve
+	if listenAddr != "" {
+		lAddr, err := net.ResolveTCPAddr("tcp4", listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		c.localAddr = lAddr
+	}
+	for _, g := range groups {
+		if _, ok := c.groups[g.Name]; ok {
+			return nil, fmt.Errorf("duplicate group: %s", g.Name)
+		}
+		c.groups[g.Name] = g
 	}
-	return &Client{localAddr: lAddr, serverAddr: rAddr, cipher: c, ruleset: r}, nil
+	if c.proxy = c.groups[ruleset.TargetProxy]; c.proxy == nil {
+		c.proxy = groups[0]
+	}
+	return c, nil
+}
+
+// Proxy 返回 ruleset 命中 PROXY 时使用的 Server 组, 可用于修改健康检查配置和查询 Server 状态
+func (c *Client) Proxy() *upstream.Group { return c.proxy }
+
+// Group 返回名为 name 的 Server 组, 不存在时返回 nil
+func (c *Client) Group(name string) *upstream.Group {
+	if name == ruleset.TargetProxy {
+		return c.proxy
+	}
+	return c.groups[name]
 }
 
 func (c *Client) Listen(didListen func(listenAddr *net.TCPAddr)) error {
-	local, err := net.ListenTCP("tcp", c.localAddr)
+	listener, err := c.listen()
 	if err != nil {
 		return errors.Trace(err)
 	}
-
-	log.Info("Client Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, local.Addr()))
 	if didListen != nil {
 		go didListen(c.localAddr)
 	}
-	c.startListen(local)
-	return nil
+	return errors.Trace(c.serve(context.Background(), listener))
 }
 
-func (c *Client) startListen(listener net.Listener) {
-	for {
-		localConn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
+// ListenAndServe 监听并处理连接, 直到 ctx 被取消或调用 Shutdown/Close. ctx 被取消时立即关闭所有连接
+func (c *Client) ListenAndServe(ctx context.Context) error {
+	listener, err := c.listen()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.serve(ctx, listener))
+}
+
+// Serve 在调用者提供的 listener 上处理连接, 例如 unix socket, systemd socket activation 或包装了 TLS 的 listener.
+// 与 ListenAndServe 一样阻塞直到 ctx 被取消或调用 Shutdown/Close, listener 在别处被关闭时返回错误.
+// 无论如何返回, listener 都已被关闭
+func (c *Client) Serve(ctx context.Context, listener net.Listener) error {
+	return errors.Trace(c.serve(ctx, listener))
+}
+
+// Shutdown 停止接受新连接, 等待正在转发的隧道结束. ctx 结束时强制关闭剩下的连接并返回 ctx.Err()
+func (c *Client) Shutdown(ctx context.Context) error {
+	return errors.Trace(c.acceptor.Shutdown(ctx))
+}
+
+// Close 停止接受新连接并立即关闭所有连接
+func (c *Client) Close() error {
+	return errors.Trace(c.acceptor.Close())
+}
+
+func (c *Client) listen() (net.Listener, error) {
+	if c.localAddr == nil {
+		return nil, fmt.Errorf("no listen addr")
+	}
+	listener, err := net.ListenTCP("tcp", c.localAddr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
+
+func (c *Client) serve(ctx context.Context, listener net.Listener) error {
+	if err := c.start(); err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	log.Info("Client Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()))
+	return c.acceptor.Serve(ctx, listener, func(localConn net.Conn) {
 		log.Debugf("%s -> %s | %s -> %s", logger.LocalStr, logger.ClientStr, localConn.RemoteAddr(), localConn.LocalAddr())
-		go func() {
-			err := c.handleConn(localConn)
+		if err := c.handleConn(localConn); err != nil {
 			log.Error(errors.ErrorStack(err))
+		}
+	})
+}
+
+// start 开始补充 Server 的连接池, 启动组的健康检查和本地 dns 服务器, 由各个入口和 DialContext 调用, 可以多次调用.
+// 连接池, 健康检查和 dns 服务器在 Shutdown/Close 时停止
+func (c *Client) start() error {
+	c.healthOnce.Do(func() {
+		for _, g := range c.groups {
+			for _, u := range g.Upstreams() {
+				u.Start()
+			}
+			// 只有一个 Server 时没有可以切换的 Server
+			if len(g.Upstreams()) > 1 {
+				g.StartHealthCheck()
+			}
+		}
+		go func() {
+			<-c.acceptor.ShutdownChan()
+			for _, g := range c.groups {
+				g.Close()
+			}
 		}()
-	}
+	})
+	return errors.Trace(c.StartDNS())
 }
 
-func (c *Client) handleConn(conn net.Conn) (err error) {
+// handleConn 根据第一个字节识别入站协议: 0x05 为 socks5, 0x04 为 socks4/4a, 大写字母开头的是 HTTP 代理请求
+func (c *Client) handleConn(conn net.Conn) error {
 	defer conn.Close()
+	if c.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.HandshakeTimeout))
+	}
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	local := connection.NewBufferedConn(conn, br)
+	switch b := first[0]; {
+	case b == 0x05:
+		return errors.Trace(c.handleSocks5(local))
+	case b == 0x04:
+		return errors.Trace(c.handleSocks4(local))
+	case b >= 'A' && b <= 'Z':
+		return errors.Trace(c.handleHTTP(context.Background(), local))
+	default:
+		return fmt.Errorf("unknown protocol, first byte: %#x", b)
+	}
+}
+
+// handleSocks5 处理 socks5 CONNECT, 设置了 HTTPUsername 时要求 RFC 1929 用户名/密码认证
+func (c *Client) handleSocks5(conn net.Conn) error {
 	local := connection.NewSecureSocket(conn, cipher.NewNopCipher())
-	handshakeReceived, requestReceived, dst, err := connection.GetSock5Data(local)
+	if err := c.socks5Auth(local); err != nil {
+		return errors.Trace(err)
+	}
+	_, dst, err := connection.ReadRequest(local)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	log.Debugf("%s -> %s | %s -> %s", logger.ClientStr, logger.ServerStr, dst.LocalAddr(), dst.RemoteAddr())
-	// dont use server to proxy conn
-	targetIP := dst.RemoteAddr()
-	if !c.ruleset.Match(targetIP.(*net.TCPAddr)) {
-		return errors.Trace(c.joinTarget(conn, targetIP.String()))
+	return errors.Trace(c.dispatch(context.Background(), conn, dst, func(rep byte) error {
+		return connection.ReplyRequest(local, rep)
+	}))
+}
+
+// socks5Auth 完成 socks5 握手, 设置了 HTTPUsername 时只接受用户名/密码认证
+func (c *Client) socks5Auth(local *connection.SecureSocket) error {
+	if c.HTTPUsername == "" {
+		_, err := connection.HandShakeHandler(local)
+		return errors.Trace(err)
+	}
+	_, methods, err := connection.ReadHandshake(local)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if bytes.IndexByte(methods, connection.MethodUserPass) < 0 {
+		_ = connection.ReplyHandshake(local, connection.MethodNoAcceptable)
+		return fmt.Errorf("socks5 client does not support user/pass auth, methods: %v", methods)
+	}
+	if err := connection.ReplyHandshake(local, connection.MethodUserPass); err != nil {
+		return errors.Trace(err)
+	}
+	username, password, err := connection.ReadUserPass(local)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !c.authorized(username, password) {
+		_ = connection.ReplyUserPass(local, connection.UserPassFailed)
+		return fmt.Errorf("socks5 auth failed, username: %q", username)
+	}
+	return errors.Trace(connection.ReplyUserPass(local, connection.UserPassSucceeded))
+}
+
+// authorized 比较入站的用户名和密码, 没有设置 HTTPUsername 时不需要认证
+func (c *Client) authorized(username, password string) bool {
+	if c.HTTPUsername == "" {
+		return true
 	}
-	// use server to proxy conn
-	return errors.Trace(c.joinServer(conn, handshakeReceived, requestReceived))
+	// 两项都比较, 不因为用户名不同提前返回
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(c.HTTPUsername))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(c.HTTPPassword))
+	return u&p == 1
 }
 
-func (c *Client) joinTarget(localConn net.Conn, dstAddr string) error {
-	targetConn, err := net.Dial("tcp", dstAddr)
+// handleSocks4 处理 socks4/4a CONNECT, conn 需要带缓冲, 见 ReadSocks4Request.
+// socks4 没有密码认证, 设置了 HTTPUsername 时拒绝
+func (c *Client) handleSocks4(conn net.Conn) error {
+	dst, userID, err := connection.ReadSocks4Request(conn)
 	if err != nil {
+		_ = connection.ReplySocks4(conn, connection.Socks4Rejected)
 		return errors.Trace(err)
 	}
-	defer targetConn.Close()
-	log.Debugf(
-		"%s <-> %s <-> %s | %s <-> %s(%s) <-> %s",
-		logger.LocalStr, logger.ClientStr, logger.TargetStr,
-		localConn.RemoteAddr(), localConn.LocalAddr(), targetConn.LocalAddr(), targetConn.RemoteAddr(),
-	)
-	return errors.Trace(connection.Copy(localConn, targetConn))
+	if c.HTTPUsername != "" {
+		_ = connection.ReplySocks4(conn, connection.Socks4Rejected)
+		return fmt.Errorf("socks4 is not allowed when auth is required, userid %q", userID)
+	}
+	log.Debugf("%s -> %s | socks4 %s userid %q", logger.LocalStr, logger.ClientStr, dst, userID)
+	return errors.Trace(c.dispatch(context.Background(), conn, dst, func(rep byte) error {
+		if rep != connection.RepSucceeded {
+			return connection.ReplySocks4(conn, connection.Socks4Rejected)
+		}
+		return connection.ReplySocks4(conn, connection.Socks4Granted)
+	}))
 }
 
-func (c *Client) joinServer(conn net.Conn, handshakeReceived, requestReceived []byte) error {
-	localConn := connection.NewSecureSocket(conn, c.cipher)
-	server, err := net.Dial("tcp", c.serverAddr.String())
+// dispatch 按 ruleset 把入站连接转发到 dst. reply 在连接目标后通知入站协议结果, 取值为 socks5 的 REP,
+// 透明代理等不需要响应的入站传 nil
+func (c *Client) dispatch(ctx context.Context, conn net.Conn, dst *connection.Addr, reply func(rep byte) error) error {
+	if reply == nil {
+		reply = func(byte) error { return nil }
+	}
+	remote, peer, rep, err := c.connect(ctx, "tcp", conn.RemoteAddr(), dst)
 	if err != nil {
+		_ = reply(rep)
+		if err == errRejected {
+			return nil
+		}
 		return errors.Trace(err)
 	}
-	serverConn := connection.NewSecureSocket(server, c.cipher)
-	defer serverConn.Close()
-	if err := connection.SendSocks5Data(serverConn, handshakeReceived, requestReceived); err != nil {
+	defer remote.Close()
+	if err := reply(connection.RepSucceeded); err != nil {
 		return errors.Trace(err)
 	}
 	log.Debugf(
 		"%s <-> %s <-> %s | %s <-> %s(%s) <-> %s",
-		logger.LocalStr, logger.ClientStr, logger.ServerStr,
-		localConn.RemoteAddr(), localConn.LocalAddr(), serverConn.LocalAddr(), serverConn.RemoteAddr(),
+		logger.LocalStr, logger.ClientStr, peer,
+		conn.RemoteAddr(), conn.LocalAddr(), remote.LocalAddr(), remote.RemoteAddr(),
 	)
-	return errors.Trace(connection.Tunnel(serverConn, localConn))
+	return errors.Trace(c.relay(conn, remote))
+}
+
+// connect 按 ruleset 连接 dst, peer 是出站在日志中的名字. 失败时 rep 是应该响应给入站的 socks5 REP,
+// 命中 REJECT 时返回 errRejected. network 为 tcp4/tcp6 时只连接该地址族的 IP, 经过 Server 时域名在本地解析.
+// ctx 结束时放弃连接
+func (c *Client) connect(
+	ctx context.Context, network string, src net.Addr, dst *connection.Addr,
+) (remote net.Conn, peer string, rep byte, err error) {
+	dst, err = c.restoreFakeIP(dst)
+	if err != nil {
+		return nil, "", connection.RepHostUnreachable, errors.Trace(err)
+	}
+	metadata := &ruleset.Metadata{Host: dst.Host, DstIP: dst.IP, DstPort: dst.Port, Resolver: c.Resolver}
+	if src, ok := src.(*net.TCPAddr); ok {
+		metadata.SrcIP, metadata.SrcPort = src.IP, src.Port
+	}
+	target := c.ruleset.Match(metadata)
+	log.Debugf("%s -> %s | %s match %s", logger.LocalStr, logger.ClientStr, metadata, target)
+	switch target {
+	case ruleset.TargetDirect:
+		// dont use server to proxy conn
+		d := c.Dialer
+		if c.Resolver != nil {
+			d = dns.NewDialer(c.Resolver, d)
+		}
+		remote, err = dialer.DialContext(ctx, d, c.DialTimeout, network, metadata.String())
+		if err != nil {
+			return nil, "", connection.RepHostUnreachable, errors.Trace(err)
+		}
+		return remote, logger.TargetStr, connection.RepSucceeded, nil
+	case ruleset.TargetReject:
+		return nil, "", connection.RepNotAllowed, errRejected
+	default:
+		// use server to proxy conn
+		group := c.Group(target)
+		if group == nil {
+			return nil, "", connection.RepGeneralFailure, fmt.Errorf("unknown target: %s", target)
+		}
+		address, err := dns.ResolveNetwork(ctx, c.Resolver, network, dst.String())
+		if err != nil {
+			return nil, "", connection.RepHostUnreachable, errors.Trace(err)
+		}
+		if dst, err = connection.NewAddr(address); err != nil {
+			return nil, "", connection.RepGeneralFailure, errors.Trace(err)
+		}
+		remote, err = group.Dial(ctx, dst)
+		if err != nil {
+			return nil, "", connection.RepGeneralFailure, errors.Trace(err)
+		}
+		return remote, logger.ServerStr, connection.RepSucceeded, nil
+	}
+}
+
+// relay 握手结束后在 local 和 remote 之间转发数据, 空闲或存活超时时关闭两端
+func (c *Client) relay(local, remote net.Conn) error {
+	if err := local.SetDeadline(time.Time{}); err != nil {
+		return errors.Trace(err)
+	}
+	watchdog := connection.NewWatchdog(c.IdleTimeout, c.MaxSessionDuration, func(reason string) {
+		log.Debugf("%s <-> %s | %s <-> %s %s", logger.LocalStr, logger.ClientStr, local.RemoteAddr(), remote.RemoteAddr(), reason)
+		local.Close()
+		remote.Close()
+	})
+	defer watchdog.Stop()
+	return errors.Trace(connection.Copy(connection.WatchConn(local, watchdog), connection.WatchConn(remote, watchdog)))
 }
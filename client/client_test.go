@@ -0,0 +1,464 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/ruleset"
+	"github.com/obgnail/shadowsocks-toy/server"
+	"github.com/obgnail/shadowsocks-toy/upstream"
+)
+
+// fakeDialer 记录连接的地址, 返回 net.Pipe 的一端, 另一端先发送 name 再回显
+type fakeDialer struct {
+	name  string
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+" "+address)
+	d.mu.Unlock()
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		if _, err := c2.Write([]byte(d.name)); err != nil {
+			return
+		}
+		io.Copy(c2, c2)
+	}()
+	return c1, nil
+}
+
+func (d *fakeDialer) dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.addrs...)
+}
+
+// startServer 启动使用 d 连接目标的 Server, 返回监听地址
+func startServer(t *testing.T, c cipher.Cipher, d dialer.Dialer) string {
+	t.Helper()
+	srv, err := server.New("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Dialer = d
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// startClient 在本地端口启动 clt, 返回监听地址
+func startClient(t *testing.T, clt *Client) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go clt.Serve(context.Background(), l)
+	t.Cleanup(func() { clt.Close() })
+	return l.Addr().String()
+}
+
+// socks5Connect 通过 socks5 代理 proxy 连接 host:port, 返回响应码
+func socks5Connect(proxy, host string, port int) (net.Conn, byte, error) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return nil, 0, err
+	}
+	reply := make([]byte, 10)
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 {
+		conn.Close()
+		return nil, 0, fmt.Errorf("unexpected method reply %v", reply[:2])
+	}
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, reply[1], nil
+}
+
+// expectGreeting 读取 fakeDialer 发送的名字并检查回显
+func expectGreeting(conn net.Conn, name string) error {
+	buf := make([]byte, len(name))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != name {
+		return fmt.Errorf("connected to %q, want %q", buf, name)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != "ping" {
+		return fmt.Errorf("echo %q", buf)
+	}
+	return nil
+}
+
+func TestClientDialer(t *testing.T) {
+	c := cipher.NewByteMapCipher()
+	serverDialer := &fakeDialer{name: "server"}
+	rules, err := ruleset.ParseRules([]string{
+		"DOMAIN-SUFFIX,direct.test,DIRECT",
+		"MATCH,PROXY",
+	}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", startServer(t, c, serverDialer), c, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDialer := &fakeDialer{name: "client"}
+	clt.Dialer = clientDialer
+	proxy := startClient(t, clt)
+
+	// DIRECT 使用 Client.Dialer
+	conn, rep, err := socks5Connect(proxy, "www.direct.test", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep != 0 {
+		t.Fatalf("direct rep %d", rep)
+	}
+	if err := expectGreeting(conn, "client"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// PROXY 经过 Server, 由 Server.Dialer 连接目标
+	conn, rep, err = socks5Connect(proxy, "www.proxy.test", 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep != 0 {
+		t.Fatalf("proxy rep %d", rep)
+	}
+	if err := expectGreeting(conn, "server"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := clientDialer.dialed(); len(got) != 1 || got[0] != "tcp www.direct.test:80" {
+		t.Fatalf("client dialed %v", got)
+	}
+	if got := serverDialer.dialed(); len(got) != 1 || got[0] != "tcp www.proxy.test:443" {
+		t.Fatalf("server dialed %v", got)
+	}
+}
+
+func TestStartDNSRestoresFakeIP(t *testing.T) {
+	rules, err := ruleset.ParseRules([]string{"MATCH,DIRECT"}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", "127.0.0.1:1", cipher.NewNopCipher(), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDialer{name: "direct"}
+	clt.Dialer = d
+	path := filepath.Join(t.TempDir(), "fakeip")
+	clt.DNS = &DNSConfig{
+		Listen:     "127.0.0.1:0",
+		Remote:     []string{"127.0.0.1:1"},
+		FakeIP:     true,
+		FakeIPFile: path,
+	}
+	// 没有调用 Serve 也可以使用假 IP
+	if err := clt.StartDNS(); err != nil {
+		t.Fatal(err)
+	}
+	if err := clt.StartDNS(); err != nil {
+		t.Fatal(err)
+	}
+	ip := clt.fakeIP.Load().Lookup("fake.test")
+	conn, err := clt.DialContext(context.Background(), "tcp", net.JoinHostPort(ip.String(), "80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := d.dialed(); len(got) != 1 || got[0] != "tcp fake.test:80" {
+		t.Fatalf("dialed %v", got)
+	}
+
+	// 关闭时保存映射
+	clt.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b, err := os.ReadFile(path)
+		if err == nil && string(b) == ip.String()+" fake.test\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fake ip file %q %v", b, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	rules, err := ruleset.ParseRules([]string{"MATCH,DIRECT"}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", "127.0.0.1:1", cipher.NewNopCipher(), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt.Dialer = &fakeDialer{name: "direct"}
+	clt.HTTPUsername, clt.HTTPPassword = "user", "pass"
+	clt.HandshakeTimeout = 2 * time.Second
+	proxy := startClient(t, clt)
+
+	// 只支持不认证的 socks5 客户端收到 X'FF'
+	if _, _, err := socks5Connect(proxy, "a.test", 80); err == nil {
+		t.Fatal("socks5 without auth connected")
+	}
+
+	auth := func(username, password string) (net.Conn, byte) {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 2)
+		if _, err := conn.Write([]byte{0x05, 0x02, 0x00, 0x02}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != 0x02 {
+			t.Fatalf("method %#x, want user/pass", reply[1])
+		}
+		req := append([]byte{0x01, byte(len(username))}, username...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply[1]
+	}
+	conn, status := auth("user", "wrong")
+	conn.Close()
+	if status == 0x00 {
+		t.Fatal("wrong password accepted")
+	}
+
+	conn, status = auth("user", "pass")
+	defer conn.Close()
+	if status != 0x00 {
+		t.Fatalf("auth status %d", status)
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00, 0x03, 6, 'a', '.', 't', 'e', 's', 't', 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("rep %d", reply[1])
+	}
+	if err := expectGreeting(conn, "direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	// socks4 没有认证, 拒绝
+	s4, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s4.Close()
+	if _, err := s4.Write([]byte{0x04, 0x01, 0, 80, 127, 0, 0, 1, 'u', 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s4, reply[:8]); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x5b {
+		t.Fatalf("socks4 reply %#x, want rejected", reply[1])
+	}
+}
+
+func TestServeReverseClose(t *testing.T) {
+	c := cipher.NewByteMapCipher()
+	// Server 默认不允许反向隧道, ServeReverse 一直重试
+	clt, err := New("", startServer(t, c, &fakeDialer{name: "server"}), c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(chan error, 1)
+	go func() { ret <- clt.ServeReverse("127.0.0.1:0", "127.0.0.1:1") }()
+	time.Sleep(100 * time.Millisecond)
+
+	// 等待重试时 Close 立即返回, 不等到退避结束
+	start := time.Now()
+	clt.Close()
+	select {
+	case err := <-ret:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("ServeReverse returned after %s", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeReverse did not return after Close")
+	}
+}
+
+// staticResolver 把所有域名解析为固定的 IP
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestDialContextNetwork(t *testing.T) {
+	c := cipher.NewByteMapCipher()
+	serverDialer := &fakeDialer{name: "server"}
+	rules, err := ruleset.ParseRules([]string{
+		"DOMAIN-SUFFIX,direct.test,DIRECT",
+		"MATCH,PROXY",
+	}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", startServer(t, c, serverDialer), c, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+	clientDialer := &fakeDialer{name: "client"}
+	clt.Dialer = clientDialer
+	clt.Resolver = staticResolver{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}
+
+	// DIRECT 解析后只连接 IPv6, 经过 Server 时在本地解析为 IPv4
+	for _, tc := range []struct{ network, address, name string }{
+		{"tcp6", "www.direct.test:80", "client"},
+		{"tcp4", "www.proxy.test:443", "server"},
+	} {
+		conn, err := clt.DialContext(context.Background(), tc.network, tc.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := expectGreeting(conn, tc.name); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if _, err := clt.DialContext(context.Background(), "tcp6", "127.0.0.1:80"); err == nil {
+		t.Fatal("dialed an IPv4 address with tcp6")
+	}
+	if got := clientDialer.dialed(); len(got) != 1 || got[0] != "tcp6 [::1]:80" {
+		t.Fatalf("client dialed %v", got)
+	}
+	if got := serverDialer.dialed(); len(got) != 1 || got[0] != "tcp 127.0.0.1:443" {
+		t.Fatalf("server dialed %v", got)
+	}
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	rules, err := ruleset.ParseRules([]string{"MATCH,DIRECT"}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", "127.0.0.1:1", cipher.NewNopCipher(), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+	canceled := make(chan struct{})
+	clt.Dialer = dialer.Func(func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := clt.DialContext(ctx, "tcp", "a.test:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dial err %v", err)
+	}
+	// ctx 传到了 Dialer, 没有在后台继续连接
+	select {
+	case <-canceled:
+	default:
+		t.Fatal("dialer did not see the canceled ctx")
+	}
+}
+
+func TestDialContextStartsHealthCheck(t *testing.T) {
+	c := cipher.NewByteMapCipher()
+	live, err := upstream.New("live", startServer(t, c, &fakeDialer{name: "server"}), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := upstream.New("dead", "127.0.0.1:1", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ruleset.ParseRules([]string{"MATCH,PROXY"}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := NewWithGroups("", rules, upstream.NewGroup(ruleset.TargetProxy, live, dead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	// 没有调用 Serve, 第一次 DialContext 时开始健康检查
+	conn, err := clt.DialContext(context.Background(), "tcp", "a.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for dead.Alive() {
+		if time.Now().After(deadline) {
+			t.Fatal("health check did not mark the dead upstream down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"net"
+)
+
+// DialContext 不经过本地监听, 直接按 ruleset 连接 address: 命中 PROXY 或组名时在加密隧道中完成握手,
+// 返回的 net.Conn 读写明文. 可以作为 http.Transport.DialContext, 也满足 golang.org/x/net/proxy.ContextDialer
+// 和 dialer.Dialer. 只支持 tcp, tcp4/tcp6 时只连接该地址族的 IP, 经过 Server 时域名在本地解析.
+// 命中 REJECT 时返回错误, ctx 结束时放弃正在进行的连接. 第一次调用时启动健康检查和本地 dns 服务器, 见 StartDNS
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+	dst, err := connection.NewAddr(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.start(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, _, _, err := c.connect(ctx, network, nil, dst)
+	if err != nil {
+		return nil, errors.Annotatef(err, "dial %s", address)
+	}
+	return conn, nil
+}
+
+// Dial 等同于 DialContext
+func (c *Client) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return c.DialContext(ctx, network, address)
+}
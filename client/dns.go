@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dns"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	"github.com/obgnail/shadowsocks-toy/ruleset"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// 运行期间保存假 IP 映射的间隔
+const fakeIPSaveInterval = time.Minute
+
+// DNSConfig 是 Client 的本地 dns 服务器配置. 请求按 ruleset 分流(目标端口为 53):
+// 域名命中 DIRECT 时直接使用 Local 上游查询, 命中 REJECT 时拒绝, 否则经过对应的 Server 组使用 Remote 上游查询
+type DNSConfig struct {
+	Listen string   // UDP 和 TCP 的监听地址, 例如 127.0.0.1:53
+	Remote []string // 经过隧道查询的上游, 隧道只支持 TCP, 没有协议的地址和 udp:// 按 tcp:// 处理
+	Local  []string // 直接查询的上游, 为空时全部经过隧道
+
+	// FakeIP 为 true 时用假 IP 响应 A 请求, 连接假 IP 时换回域名再匹配规则, Server 解析真实地址. 用于透明代理
+	FakeIP       bool
+	FakeIPRange  string   // 默认为 198.18.0.0/15
+	FakeIPSize   int      // 最多保留的映射数量, 0 表示使用整个地址段
+	FakeIPFile   string   // 保存映射的文件, 运行期间定期写入, 停止时写入, 启动时恢复
+	FakeIPFilter []string // 不使用假 IP 的域名后缀, 例如局域网域名
+}
+
+type dnsForwarder struct {
+	client *Client
+	local  *dns.Client
+	remote map[string]*dns.Client // key 为组名
+	fakeIP *dns.FakeIP
+	filter []string
+}
+
+func (c *Client) newDNSForwarder(cfg *DNSConfig) (*dnsForwarder, error) {
+	if len(cfg.Remote) == 0 {
+		return nil, fmt.Errorf("no remote dns upstream")
+	}
+	f := &dnsForwarder{client: c, remote: make(map[string]*dns.Client, len(c.groups))}
+	for name, g := range c.groups {
+		var upstreams []dns.Upstream
+		for _, addr := range cfg.Remote {
+			u, err := dns.NewUpstream(tunnelDNSAddr(addr), g)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			upstreams = append(upstreams, u)
+		}
+		f.remote[name] = dns.NewClient(upstreams...)
+	}
+	if len(cfg.Local) != 0 {
+		local, err := dns.ParseClient(cfg.Local...)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		f.local = local
+	}
+	if cfg.FakeIP {
+		cidr := cfg.FakeIPRange
+		if cidr == "" {
+			cidr = dns.DefaultFakeIPRange
+		}
+		fakeIP, err := dns.NewFakeIP(cidr, cfg.FakeIPSize)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if cfg.FakeIPFile != "" {
+			if err := fakeIP.Load(cfg.FakeIPFile); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		f.fakeIP = fakeIP
+		for _, suffix := range cfg.FakeIPFilter {
+			f.filter = append(f.filter, strings.ToLower(strings.Trim(suffix, ".")))
+		}
+	}
+	return f, nil
+}
+
+func (f *dnsForwarder) useFakeIP(q dns.Question) bool {
+	if f.fakeIP == nil || (q.Type != dns.TypeA && q.Type != dns.TypeAAAA) {
+		return false
+	}
+	for _, suffix := range f.filter {
+		if q.Name == suffix || strings.HasSuffix(q.Name, "."+suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// tunnelDNSAddr 隧道中没有 UDP, 改用 TCP 查询
+func tunnelDNSAddr(addr string) string {
+	if !strings.Contains(addr, "://") {
+		return "tcp://" + addr
+	}
+	if strings.HasPrefix(addr, "udp://") {
+		return "tcp://" + strings.TrimPrefix(addr, "udp://")
+	}
+	return addr
+}
+
+func (f *dnsForwarder) ServeDNS(ctx context.Context, query []byte) ([]byte, error) {
+	m, err := dns.Unpack(query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(m.Questions) == 0 {
+		return dns.ErrorReply(query, dns.RcodeFormatError), nil
+	}
+	name := m.Questions[0].Name
+	// 连接时才匹配规则
+	if f.useFakeIP(m.Questions[0]) {
+		return f.fakeIP.ServeDNS(ctx, query)
+	}
+	proxy := f.remote[f.client.proxy.Name]
+	metadata := &ruleset.Metadata{Host: name, DstPort: 53, Resolver: proxy}
+	if f.local != nil {
+		metadata.Resolver = f.local
+	}
+	target := f.client.ruleset.Match(metadata)
+	log.Debugf("%s -> %s | dns %s match %s", logger.LocalStr, logger.ClientStr, name, target)
+
+	switch target {
+	case ruleset.TargetReject:
+		return dns.ErrorReply(query, dns.RcodeRefused), nil
+	case ruleset.TargetDirect:
+		if f.local != nil {
+			return f.local.ServeDNS(ctx, query)
+		}
+		return proxy.ServeDNS(ctx, query)
+	case ruleset.TargetProxy:
+		return proxy.ServeDNS(ctx, query)
+	default:
+		r, ok := f.remote[target]
+		if !ok {
+			return nil, fmt.Errorf("unknown target: %s", target)
+		}
+		return r.ServeDNS(ctx, query)
+	}
+}
+
+// StartDNS 按 DNS 启动本地 dns 服务器, DNS 为 nil 或已经启动时直接返回, 监听失败时返回错误.
+// Serve, ServeHTTPProxy, ServeTunnel, 透明代理和 DialContext 会自动调用, 也可以提前调用以便尽早发现监听失败.
+// 调用 Shutdown/Close 时关闭服务器并保存假 IP 的映射, 运行期间每 fakeIPSaveInterval 保存一次
+func (c *Client) StartDNS() error {
+	c.dnsMu.Lock()
+	defer c.dnsMu.Unlock()
+	if c.DNS == nil || c.dnsStarted {
+		return nil
+	}
+	f, err := c.newDNSForwarder(c.DNS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	conn, err := net.ListenPacket("udp", c.DNS.Listen)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	c.dnsStarted = true
+	c.fakeIP.Store(f.fakeIP)
+	log.Info("Client DNS Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, conn.LocalAddr()))
+	srv := dns.NewServer(f)
+	go func() {
+		if err := srv.Serve(conn, listener); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	}()
+	go c.runDNS(srv, f.fakeIP, c.DNS.FakeIPFile)
+	return nil
+}
+
+// runDNS 定期保存假 IP 的映射, 避免异常退出时丢失, Client 关闭时关闭 dns 服务器
+func (c *Client) runDNS(srv *dns.Server, fakeIP *dns.FakeIP, path string) {
+	save := func() {
+		if fakeIP == nil || path == "" || !fakeIP.Dirty() {
+			return
+		}
+		if err := fakeIP.Save(path); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	}
+	ticker := time.NewTicker(fakeIPSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			save()
+		case <-c.acceptor.ShutdownChan():
+			srv.Close()
+			save()
+			return
+		}
+	}
+}
+
+// restoreFakeIP 目标是假 IP 时换回域名
+func (c *Client) restoreFakeIP(dst *connection.Addr) (*connection.Addr, error) {
+	fakeIP := c.fakeIP.Load()
+	if fakeIP == nil || dst.IP == nil || !fakeIP.Contains(dst.IP) {
+		return dst, nil
+	}
+	host, ok := fakeIP.Host(dst.IP)
+	if !ok {
+		return nil, fmt.Errorf("unknown fake ip: %s", dst.IP)
+	}
+	return &connection.Addr{Host: host, Port: dst.Port}, nil
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/dns"
+	"github.com/obgnail/shadowsocks-toy/ruleset"
+)
+
+// testDNS 是进程内的 dns 服务器, 所有 A 请求都用 ip 响应, 记录收到的请求
+type testDNS struct {
+	ip net.IP
+
+	mu      sync.Mutex
+	queries []string // "udp name" 或 "tcp name"
+}
+
+func (s *testDNS) handler(network string) dns.Handler {
+	return dns.HandlerFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		m, err := dns.Unpack(query)
+		if err != nil {
+			return nil, err
+		}
+		q := m.Questions[0]
+		s.mu.Lock()
+		s.queries = append(s.queries, network+" "+q.Name)
+		s.mu.Unlock()
+		var answers []dns.Record
+		if r := dns.NewIPRecord(q.Name, s.ip, 60); r.Type == q.Type {
+			answers = append(answers, r)
+		}
+		return m.Reply(dns.RcodeSuccess, answers...).Pack()
+	})
+}
+
+func (s *testDNS) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// startDNS 在同一个端口上监听 UDP 和 TCP, 返回地址
+func startDNS(t *testing.T, ip string) (*testDNS, string) {
+	t.Helper()
+	s := &testDNS{ip: net.ParseIP(ip)}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	udp, tcp := dns.NewServer(s.handler("udp")), dns.NewServer(s.handler("tcp"))
+	go udp.Serve(conn, nil)
+	go tcp.Serve(nil, listener)
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	return s, conn.LocalAddr().String()
+}
+
+// lookup 通过 f 查询 name 的 A 记录
+func lookup(t *testing.T, f *dnsForwarder, name string) net.IP {
+	t.Helper()
+	query, err := dns.NewQuery(1, name, dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.ServeDNS(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := dns.Unpack(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 1 {
+		t.Fatalf("%s: %d answers, rcode %d", name, len(m.Answers), m.Rcode)
+	}
+	return m.Answers[0].IP()
+}
+
+func TestDNSSplit(t *testing.T) {
+	local, localAddr := startDNS(t, "10.0.0.1")
+	remote, remoteAddr := startDNS(t, "10.0.0.2")
+
+	// 记录 Server 连接的地址
+	var mu sync.Mutex
+	var dialed []string
+	d := dialer.Func(func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, network+" "+address)
+		mu.Unlock()
+		return dialer.Direct.DialContext(ctx, network, address)
+	})
+	c := cipher.NewByteMapCipher()
+	rules, err := ruleset.ParseRules([]string{
+		"DOMAIN-SUFFIX,cn.test,DIRECT",
+		"DOMAIN,blocked.test,REJECT",
+		"MATCH,PROXY",
+	}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", startServer(t, c, d), c, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := clt.newDNSForwarder(&DNSConfig{
+		Remote: []string{"udp://" + remoteAddr},
+		Local:  []string{localAddr},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip := lookup(t, f, "www.cn.test"); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("www.cn.test resolved to %s", ip)
+	}
+	if ip := lookup(t, f, "example.test"); !ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("example.test resolved to %s", ip)
+	}
+
+	// 国内域名直接用 UDP 查询本地上游, 其他域名经过 Server 用 TCP 查询远程上游
+	if got := local.received(); len(got) != 1 || got[0] != "udp www.cn.test" {
+		t.Fatalf("local dns received %v", got)
+	}
+	if got := remote.received(); len(got) != 1 || got[0] != "tcp example.test" {
+		t.Fatalf("remote dns received %v", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != "tcp "+remoteAddr {
+		t.Fatalf("server dialed %v", dialed)
+	}
+
+	query, err := dns.NewQuery(2, "blocked.test", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.ServeDNS(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := dns.Unpack(resp); err != nil || m.Rcode != dns.RcodeRefused {
+		t.Fatalf("blocked.test: %+v %v", m, err)
+	}
+}
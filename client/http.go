@@ -0,0 +1,270 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// 只在相邻两跳之间有效的头部, 转发时去掉, 见 RFC 7230 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ServeHTTPProxy 在 listener 上接受 HTTP 代理请求: CONNECT 建立隧道, 绝对 URI 的普通请求去掉 hop-by-hop 头后转发给目标,
+// 与 socks5 连接一样按 ruleset 选择出站. 设置了 HTTPUsername 时要求 Basic 认证, 与 Serve 共用 Shutdown/Close.
+// ctx 结束时关闭, 也用于连接目标
+func (c *Client) ServeHTTPProxy(ctx context.Context, listener net.Listener) error {
+	if err := c.start(); err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	log.Info("Client HTTP Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()))
+	return errors.Trace(c.acceptor.Serve(ctx, listener, func(conn net.Conn) {
+		log.Debugf("%s -> %s | %s -> %s http", logger.LocalStr, logger.ClientStr, conn.RemoteAddr(), conn.LocalAddr())
+		if err := c.handleHTTP(ctx, conn); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	}))
+}
+
+func (c *Client) handleHTTP(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	if c.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.HandshakeTimeout))
+	}
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if req.Method == http.MethodConnect {
+		return errors.Trace(c.httpConnect(ctx, conn, br, req))
+	}
+
+	// 普通代理请求, 客户端可以在同一个连接上继续发送请求, 空闲或存活超时时关闭
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return errors.Trace(err)
+	}
+	p := &httpForwarder{ctx: ctx, client: c, conn: conn}
+	defer p.closeRemote()
+	p.watchdog = connection.NewWatchdog(c.IdleTimeout, c.MaxSessionDuration, func(reason string) {
+		log.Debugf("%s <-> %s | %s http %s", logger.LocalStr, logger.ClientStr, conn.RemoteAddr(), reason)
+		conn.Close()
+	})
+	defer p.watchdog.Stop()
+	for {
+		keepAlive, err := p.forward(req)
+		if err != nil || !keepAlive {
+			return errors.Trace(err)
+		}
+		if req, err = http.ReadRequest(br); err != nil {
+			// 客户端关闭了 keep-alive 连接
+			return nil
+		}
+		if req.Method == http.MethodConnect {
+			p.watchdog.Stop()
+			p.closeRemote()
+			return errors.Trace(c.httpConnect(ctx, conn, br, req))
+		}
+	}
+}
+
+// httpConnect 处理 CONNECT, 连接目标后响应 200 并转发数据
+func (c *Client) httpConnect(ctx context.Context, conn net.Conn, br *bufio.Reader, req *http.Request) error {
+	log.Debugf("%s -> %s | %s %s", logger.LocalStr, logger.ClientStr, req.Method, req.Host)
+	if !c.httpAuthorized(req) {
+		return errors.Trace(writeHTTPAuthRequired(conn))
+	}
+	dst, err := connection.NewAddr(withDefaultPort(req.Host, "443"))
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadRequest)
+		return errors.Trace(err)
+	}
+	local := conn
+	if br.Buffered() > 0 {
+		// 客户端没有等待响应就发送了数据
+		local = connection.NewBufferedConn(conn, br)
+	}
+	return errors.Trace(c.dispatch(ctx, local, dst, func(rep byte) error {
+		if rep != connection.RepSucceeded {
+			return writeHTTPStatus(conn, httpStatus(rep))
+		}
+		_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}))
+}
+
+// httpForwarder 转发同一个客户端连接上的普通代理请求, 目标与上一个请求相同时复用到目标的连接
+type httpForwarder struct {
+	ctx      context.Context
+	client   *Client
+	conn     net.Conn
+	watchdog *connection.Watchdog
+
+	remote     net.Conn
+	remoteAddr string
+	remoteR    *bufio.Reader
+}
+
+// forward 把 req 转发给目标, 把响应写回客户端, 返回是否可以继续读取下一个请求
+func (p *httpForwarder) forward(req *http.Request) (keepAlive bool, err error) {
+	log.Debugf("%s -> %s | %s %s", logger.LocalStr, logger.ClientStr, req.Method, req.URL)
+	p.watchdog.Touch()
+	if !p.client.httpAuthorized(req) {
+		return false, errors.Trace(writeHTTPAuthRequired(p.conn))
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		_ = writeHTTPStatus(p.conn, http.StatusBadRequest)
+		return false, fmt.Errorf("not a proxy request: %s", req.URL)
+	}
+	addr := withDefaultPort(req.URL.Host, "80")
+	if p.remote == nil || p.remoteAddr != addr {
+		p.closeRemote()
+		dst, err := connection.NewAddr(addr)
+		if err != nil {
+			_ = writeHTTPStatus(p.conn, http.StatusBadRequest)
+			return false, errors.Trace(err)
+		}
+		remote, peer, rep, err := p.client.connect(p.ctx, "tcp", p.conn.RemoteAddr(), dst)
+		if err != nil {
+			_ = writeHTTPStatus(p.conn, httpStatus(rep))
+			if err == errRejected {
+				return false, nil
+			}
+			return false, errors.Trace(err)
+		}
+		log.Debugf(
+			"%s <-> %s <-> %s | %s <-> %s(%s) <-> %s",
+			logger.LocalStr, logger.ClientStr, peer,
+			p.conn.RemoteAddr(), p.conn.LocalAddr(), remote.LocalAddr(), remote.RemoteAddr(),
+		)
+		p.remote = connection.WatchConn(remote, p.watchdog)
+		p.remoteAddr = addr
+		p.remoteR = bufio.NewReader(p.remote)
+	}
+
+	removeHopByHopHeaders(req.Header)
+	if err := req.Write(p.remote); err != nil {
+		p.closeRemote()
+		_ = writeHTTPStatus(p.conn, http.StatusBadGateway)
+		return false, errors.Trace(err)
+	}
+	resp, err := http.ReadResponse(p.remoteR, req)
+	if err != nil {
+		p.closeRemote()
+		_ = writeHTTPStatus(p.conn, http.StatusBadGateway)
+		return false, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.Close {
+		defer p.closeRemote()
+	}
+	removeHopByHopHeaders(resp.Header)
+	keepAlive = !req.Close && !resp.Close
+	resp.Close = !keepAlive
+	if err := resp.Write(connection.WatchConn(p.conn, p.watchdog)); err != nil {
+		return false, errors.Trace(err)
+	}
+	return keepAlive, nil
+}
+
+func (p *httpForwarder) closeRemote() {
+	if p.remote != nil {
+		p.remote.Close()
+		p.remote, p.remoteAddr, p.remoteR = nil, "", nil
+	}
+}
+
+// httpAuthorized 检查 Proxy-Authorization, 没有设置 HTTPUsername 时不需要认证
+func (c *Client) httpAuthorized(req *http.Request) bool {
+	if c.HTTPUsername == "" {
+		return true
+	}
+	const prefix = "Basic "
+	auth := req.Header.Get("Proxy-Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	token, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(token), ":")
+	return ok && c.authorized(username, password)
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	// Connection 中列出的头部也只在这一跳有效
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// httpStatus 把 socks5 的 REP 转换为 HTTP 状态码
+func httpStatus(rep byte) int {
+	switch rep {
+	case connection.RepNotAllowed:
+		return http.StatusForbidden
+	case connection.RepCommandNotSupported:
+		return http.StatusMethodNotAllowed
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeHTTPStatus(w io.Writer, code int) error {
+	return writeHTTPResponse(w, code, make(http.Header))
+}
+
+func writeHTTPAuthRequired(w io.Writer) error {
+	header := make(http.Header)
+	header.Set("Proxy-Authenticate", `Basic realm="shadowsocks-toy"`)
+	return writeHTTPResponse(w, http.StatusProxyAuthRequired, header)
+}
+
+// writeHTTPResponse 写入没有 body 的响应, 之后关闭连接
+func writeHTTPResponse(w io.Writer, code int, header http.Header) error {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      true,
+	}
+	return errors.Trace(resp.Write(w))
+}
+
+// withDefaultPort 在 host 没有端口时加上 port
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
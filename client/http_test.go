@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/ruleset"
+)
+
+// startHTTPProxy 在本地端口上用 clt 提供 HTTP 代理, 返回监听地址和 ServeHTTPProxy 的返回值
+func startHTTPProxy(t *testing.T, ctx context.Context, clt *Client) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- clt.ServeHTTPProxy(ctx, l) }()
+	t.Cleanup(func() { clt.Close() })
+	return l.Addr().String(), served
+}
+
+func newDirectClient(t *testing.T) *Client {
+	t.Helper()
+	rules, err := ruleset.ParseRules([]string{"MATCH,DIRECT"}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", "127.0.0.1:1", cipher.NewNopCipher(), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clt
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	received := make(chan *http.Request, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.Header().Set("Connection", "X-Resp-Hop")
+		w.Header().Set("X-Resp-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Resp-Keep", "1")
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer target.Close()
+
+	proxy, _ := startHTTPProxy(t, context.Background(), newDirectClient(t))
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// 同一个连接上的两个请求
+	for _, path := range []string{"/a?q=1", "/b"} {
+		req, err := http.NewRequest(http.MethodGet, target.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "keep-alive, X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("X-Keep", "1")
+		// 代理请求使用绝对 URI
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "hello "+req.URL.Path {
+			t.Fatalf("%s: %s %q", path, resp.Status, body)
+		}
+		for _, name := range []string{"X-Resp-Hop", "Proxy-Authenticate"} {
+			if v := resp.Header.Get(name); v != "" {
+				t.Fatalf("%s: response header %s: %s not removed", path, name, v)
+			}
+		}
+		if resp.Header.Get("X-Resp-Keep") != "1" {
+			t.Fatalf("%s: response header X-Resp-Keep removed", path)
+		}
+
+		r := <-received
+		if r.RequestURI != path {
+			t.Fatalf("target received %s, want %s", r.RequestURI, path)
+		}
+		for _, name := range []string{"X-Hop", "Keep-Alive", "Proxy-Connection"} {
+			if v := r.Header.Get(name); v != "" {
+				t.Fatalf("%s: request header %s: %s not removed", path, name, v)
+			}
+		}
+		if r.Header.Get("X-Keep") != "1" {
+			t.Fatalf("%s: request header X-Keep removed", path)
+		}
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	clt := newDirectClient(t)
+	d := &fakeDialer{name: "direct"}
+	clt.Dialer = d
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, served := startHTTPProxy(t, ctx, clt)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("CONNECT a.test:443 HTTP/1.1\r\nHost: a.test:443\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect: %s", resp.Status)
+	}
+	if err := expectGreeting(connection.NewBufferedConn(conn, br), "direct"); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.dialed(); len(got) != 1 || got[0] != "tcp a.test:443" {
+		t.Fatalf("dialed %v", got)
+	}
+
+	// ctx 结束时停止服务
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve not returned after ctx canceled")
+	}
+}
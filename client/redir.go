@@ -0,0 +1,39 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// ServeRedir 在 listener 上接受被 iptables/nftables REDIRECT 的 TCP 连接, 通过 SO_ORIGINAL_DST 取得原始目标,
+// 之后与 socks5 连接一样按 ruleset 转发. 只支持 Linux, 与 Serve 共用 Shutdown/Close, ctx 结束时关闭
+func (c *Client) ServeRedir(ctx context.Context, listener net.Listener) error {
+	if err := c.start(); err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	log.Info("Client Redir Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()))
+	return errors.Trace(c.acceptor.Serve(ctx, listener, func(conn net.Conn) {
+		log.Debugf("%s -> %s | %s -> %s redir", logger.LocalStr, logger.ClientStr, conn.RemoteAddr(), conn.LocalAddr())
+		if err := c.handleRedir(conn); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	}))
+}
+
+func (c *Client) handleRedir(conn net.Conn) error {
+	defer conn.Close()
+	dst, err := originalDst(conn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// 直接连接 redir 端口时原始目标就是自己, 转发会形成环路
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+		return fmt.Errorf("connection to %s was not redirected", dst)
+	}
+	return errors.Trace(c.dispatch(context.Background(), conn, dst, nil))
+}
@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST, linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST, linux/netfilter_ipv6/ip6_tables.h
+)
+
+// originalDst 通过 SO_ORIGINAL_DST 取得 REDIRECT 之前的目标地址.
+// 借用 GetsockoptIPv6Mreq/GetsockoptIPv6MTUInfo 读取 sockaddr_in/sockaddr_in6
+func originalDst(conn net.Conn) (*connection.Addr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a tcp conn: %T", conn)
+	}
+	local, _ := tcpConn.LocalAddr().(*net.TCPAddr)
+	isIPv6 := local != nil && local.IP.To4() == nil
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var dst *connection.Addr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if isIPv6 {
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			sa := (*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))
+			dst, sockErr = parseSockaddrInet6(sa[:])
+			return
+		}
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		dst, sockErr = parseSockaddrInet4(mreq.Multiaddr[:])
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if sockErr != nil {
+		return nil, errors.Annotate(sockErr, "getsockopt SO_ORIGINAL_DST")
+	}
+	return dst, nil
+}
+
+// parseSockaddrInet4 解析 sockaddr_in: family(2) | port(2) | addr(4), port 为网络字节序
+func parseSockaddrInet4(sa []byte) (*connection.Addr, error) {
+	if len(sa) < 8 {
+		return nil, fmt.Errorf("short sockaddr_in: %d", len(sa))
+	}
+	if family := *(*uint16)(unsafe.Pointer(&sa[0])); family != syscall.AF_INET {
+		return nil, fmt.Errorf("unexpected family: %d", family)
+	}
+	return &connection.Addr{
+		IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+		Port: int(sa[2])<<8 | int(sa[3]),
+	}, nil
+}
+
+// parseSockaddrInet6 解析 sockaddr_in6: family(2) | port(2) | flowinfo(4) | addr(16) | scope_id(4), port 为网络字节序
+func parseSockaddrInet6(sa []byte) (*connection.Addr, error) {
+	if len(sa) < 24 {
+		return nil, fmt.Errorf("short sockaddr_in6: %d", len(sa))
+	}
+	if family := *(*uint16)(unsafe.Pointer(&sa[0])); family != syscall.AF_INET6 {
+		return nil, fmt.Errorf("unexpected family: %d", family)
+	}
+	return &connection.Addr{
+		IP:   append(net.IP(nil), sa[8:24]...),
+		Port: int(sa[2])<<8 | int(sa[3]),
+	}, nil
+}
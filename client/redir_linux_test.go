@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestParseSockaddrInet4(t *testing.T) {
+	raw := syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte{192, 0, 2, 1}}
+	sa := (*[syscall.SizeofSockaddrInet4]byte)(unsafe.Pointer(&raw))
+	// 端口为网络字节序
+	sa[2], sa[3] = 0x1f, 0x90
+	dst, err := parseSockaddrInet4(sa[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dst.IP.Equal(net.ParseIP("192.0.2.1")) || dst.Port != 8080 {
+		t.Fatalf("parsed %s", dst)
+	}
+
+	raw.Family = syscall.AF_INET6
+	if _, err := parseSockaddrInet4(sa[:]); err == nil {
+		t.Fatal("parsed sockaddr_in6 as sockaddr_in")
+	}
+	if _, err := parseSockaddrInet4(sa[:4]); err == nil {
+		t.Fatal("parsed short sockaddr_in")
+	}
+}
+
+func TestParseSockaddrInet6(t *testing.T) {
+	raw := syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Flowinfo: 7, Scope_id: 3}
+	copy(raw.Addr[:], net.ParseIP("2001:db8::1"))
+	sa := (*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&raw))
+	sa[2], sa[3] = 0x01, 0xbb
+	dst, err := parseSockaddrInet6(sa[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dst.IP.Equal(net.ParseIP("2001:db8::1")) || dst.Port != 443 {
+		t.Fatalf("parsed %s", dst)
+	}
+	// 不引用 raw 的内存
+	raw.Addr[15] = 2
+	if !dst.IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("parsed ip changed to %s", dst.IP)
+	}
+
+	raw.Family = syscall.AF_INET
+	if _, err := parseSockaddrInet6(sa[:]); err == nil {
+		t.Fatal("parsed sockaddr_in as sockaddr_in6")
+	}
+	if _, err := parseSockaddrInet6(sa[:16]); err == nil {
+		t.Fatal("parsed short sockaddr_in6")
+	}
+}
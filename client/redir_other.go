@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"fmt"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"net"
+	"runtime"
+)
+
+func originalDst(conn net.Conn) (*connection.Addr, error) {
+	return nil, fmt.Errorf("redir is not supported on %s", runtime.GOOS)
+}
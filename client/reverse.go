@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+const maxReverseRetryDelay = 30 * time.Second
+
+// ServeReverse 请求 PROXY 组的 Server 在 remoteAddr 上监听(反向隧道), Server 接受的连接经过加密的 mux session
+// 转发回来, 再连接本地的 localAddr, 类似 ssh -R. 与 Server 断开时重新注册, 直到调用 Shutdown/Close.
+// 需要 Server 开启 Mux 和 Reverse
+func (c *Client) ServeReverse(remoteAddr, localAddr string) error {
+	addr, err := connection.NewAddr(remoteAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var delay time.Duration
+	for !c.acceptor.Closed() {
+		listener, err := c.proxy.ListenReverse(addr)
+		if err == nil {
+			log.Info("Client Reverse Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, remoteAddr), " -> ", localAddr)
+			delay = 0
+			err = c.acceptor.Serve(context.Background(), listener, func(conn net.Conn) {
+				if err := c.handleReverse(conn, localAddr); err != nil {
+					log.Error(errors.ErrorStack(err))
+				}
+			})
+			if err == nil {
+				// Shutdown/Close
+				return nil
+			}
+		}
+		if delay == 0 {
+			delay = time.Second
+		} else if delay *= 2; delay > maxReverseRetryDelay {
+			delay = maxReverseRetryDelay
+		}
+		log.Warnf("reverse tunnel %s err: %s, retrying in %s", remoteAddr, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-c.acceptor.ShutdownChan():
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *Client) handleReverse(conn net.Conn, localAddr string) error {
+	defer conn.Close()
+	local, err := dialer.Dial(dialer.Direct, c.DialTimeout, "tcp", localAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer local.Close()
+	log.Debugf(
+		"%s -> %s -> %s | %s -> %s reverse",
+		logger.ServerStr, logger.ClientStr, logger.LocalStr, conn.RemoteAddr(), local.RemoteAddr(),
+	)
+	return errors.Trace(c.relay(conn, local))
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	"github.com/obgnail/shadowsocks-toy/ruleset"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+)
+
+// ServeTProxy 在 ListenTProxy 返回的 listener 上接受被 TPROXY 的 TCP 连接, 连接的本地地址就是原始目标,
+// 之后与 socks5 连接一样按 ruleset 转发. 只支持 Linux, 与 Serve 共用 Shutdown/Close, ctx 结束时关闭
+func (c *Client) ServeTProxy(ctx context.Context, listener net.Listener) error {
+	if err := c.start(); err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	log.Info("Client TProxy Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()))
+	return errors.Trace(c.acceptor.Serve(ctx, listener, func(conn net.Conn) {
+		log.Debugf("%s -> %s | %s -> %s tproxy", logger.LocalStr, logger.ClientStr, conn.RemoteAddr(), conn.LocalAddr())
+		if err := c.handleTProxy(conn); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	}))
+}
+
+func (c *Client) handleTProxy(conn net.Conn) error {
+	defer conn.Close()
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("not a tcp conn: %T", conn)
+	}
+	dst := connection.UDPAddr(&net.UDPAddr{IP: local.IP, Port: local.Port})
+	return errors.Trace(c.dispatch(context.Background(), conn, dst, nil))
+}
+
+// ServeTProxyUDP 在 ListenTProxyUDP 返回的 conn 上接收被 TPROXY 的 UDP 包, 按 (来源, 原始目标) 建立会话,
+// 按 ruleset 直接发送或经过 Server 的 UDP relay 转发, 响应以原始目标为来源地址发回. 只支持 Linux, ctx 结束时关闭
+func (c *Client) ServeTProxyUDP(ctx context.Context, conn *net.UDPConn) error {
+	if err := c.start(); err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	log.Info("Client TProxy UDP Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, conn.LocalAddr()))
+	return errors.Trace(c.acceptor.ServePacket(ctx, conn, func(net.PacketConn) error {
+		return c.serveTProxyUDP(conn)
+	}))
+}
+
+func (c *Client) serveTProxyUDP(conn *net.UDPConn) error {
+	sessions := newUDPSessions()
+	defer sessions.closeAll()
+
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, connection.MaxUDPPacketSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// 单个包出错时丢弃这个包, 不影响之后的包
+		dst, err := origDst(oob[:oobn])
+		if err != nil {
+			log.Warnf("%s -> %s | udp packet from %s dropped: %s", logger.LocalStr, logger.ClientStr, src, err)
+			continue
+		}
+		if ip4 := src.IP.To4(); ip4 != nil {
+			src.IP = ip4
+		}
+		if local != nil && dst.Port == local.Port && (dst.IP.Equal(local.IP) || (local.IP.IsUnspecified() && dst.IP.IsLoopback())) {
+			log.Debugf("udp packet from %s to %s was not redirected", src, dst)
+			continue
+		}
+		sessions.deliver(src.String()+"->"+dst.String(), buf[:n], func(session *udpSession) {
+			c.runUDPSession(session, src, dst)
+		})
+	}
+}
+
+// runUDPSession 按 ruleset 连接出站, 把目标的响应以 dst 为来源发回 src
+func (c *Client) runUDPSession(session *udpSession, src, dst *net.UDPAddr) {
+	defer session.close()
+	out, err := c.dialUDP(src, dst)
+	if err != nil {
+		if err != errRejected {
+			log.Debugf("%s -> %s | udp %s -> %s err: %s", logger.LocalStr, logger.ClientStr, src, dst, err)
+		}
+		return
+	}
+	defer out.Close()
+	reply, err := listenTProxyReply(dst)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		return
+	}
+	defer reply.Close()
+	c.relayUDP(session, out, reply, src, dst.String())
+}
+
+// dialUDP 按 ruleset 选择 UDP 出站, 命中 REJECT 时返回 errRejected
+func (c *Client) dialUDP(src, orig *net.UDPAddr) (udpOutbound, error) {
+	dst, err := c.restoreFakeIP(connection.UDPAddr(orig))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	metadata := &ruleset.Metadata{
+		Host: dst.Host, DstIP: dst.IP, DstPort: dst.Port,
+		SrcIP: src.IP, SrcPort: src.Port, Resolver: c.Resolver,
+	}
+	target := c.ruleset.Match(metadata)
+	log.Debugf("%s -> %s | udp %s match %s", logger.LocalStr, logger.ClientStr, metadata, target)
+	switch target {
+	case ruleset.TargetReject:
+		return nil, errRejected
+	case ruleset.TargetDirect:
+		ip := metadata.ResolveIP()
+		if ip == nil {
+			return nil, fmt.Errorf("resolve %s failed", metadata)
+		}
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(dst.Port))
+		conn, err := dialer.Dial(c.Dialer, c.DialTimeout, "udp", addr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &directUDP{conn}, nil
+	default:
+		group := c.Group(target)
+		if group == nil {
+			return nil, fmt.Errorf("unknown target: %s", target)
+		}
+		conn, err := group.DialUDP(context.Background(), dst)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &tunnelUDP{conn: conn, dst: dst}, nil
+	}
+}
@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"net"
+	"syscall"
+)
+
+const (
+	ipTransparent       = 19 // IP_TRANSPARENT
+	ipRecvOrigDstAddr   = 20 // IP_RECVORIGDSTADDR, 也是 IP_ORIGDSTADDR
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR, 也是 IPV6_ORIGDSTADDR
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+)
+
+// ListenTProxy 创建 TPROXY 使用的 TCP listener, 需要 CAP_NET_ADMIN
+func ListenTProxy(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
+
+// ListenTProxyUDP 创建 TPROXY 使用的 UDP conn, 接收时可以取得原始目标, 需要 CAP_NET_ADMIN
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenTProxyReply 创建绑定在原始目标上的 UDP conn, 用于以原始目标为来源发回响应
+func listenTProxyReply(dst *net.UDPAddr) (net.PacketConn, error) {
+	network := "udp6"
+	if dst.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+				return
+			}
+			sockErr = setsockoptBoth(int(fd), ipTransparent, ipv6Transparent)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), network, dst.String())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if sockErr = setsockoptBoth(int(fd), ipTransparent, ipv6Transparent); sockErr != nil {
+				return
+			}
+			if recvOrigDst {
+				sockErr = setsockoptBoth(int(fd), ipRecvOrigDstAddr, ipv6RecvOrigDstAddr)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return errors.Annotate(sockErr, "setsockopt")
+	}
+}
+
+// setsockoptBoth 同时设置 IPv4 和 IPv6 的选项, 双栈 socket 两者都需要, IPv4 socket 设置 IPv6 的选项会失败
+func setsockoptBoth(fd, v4Opt, v6Opt int) error {
+	v4Err := syscall.SetsockoptInt(fd, syscall.SOL_IP, v4Opt, 1)
+	v6Err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, v6Opt, 1)
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
+
+// origDst 从 ReadMsgUDP 读到的 IP_ORIGDSTADDR/IPV6_ORIGDSTADDR 中取得原始目标
+func origDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, msg := range msgs {
+		data := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == ipRecvOrigDstAddr && len(data) >= 8:
+			// sockaddr_in: family(2) | port(2) | addr(4)
+			return &net.UDPAddr{IP: net.IPv4(data[4], data[5], data[6], data[7]).To4(), Port: int(binary.BigEndian.Uint16(data[2:4]))}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(data) >= 24:
+			// sockaddr_in6: family(2) | port(2) | flowinfo(4) | addr(16) | scope_id(4)
+			dst := &net.UDPAddr{IP: append(net.IP(nil), data[8:24]...), Port: int(binary.BigEndian.Uint16(data[2:4]))}
+			if ip4 := dst.IP.To4(); ip4 != nil {
+				dst.IP = ip4
+			}
+			return dst, nil
+		}
+	}
+	return nil, fmt.Errorf("no original destination")
+}
@@ -0,0 +1,240 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/dns"
+	"github.com/obgnail/shadowsocks-toy/ruleset"
+	"github.com/obgnail/shadowsocks-toy/server"
+)
+
+const netnsEnv = "SS_TOY_TEST_NETNS"
+
+// runInNetns 在新的 network namespace 中重新运行当前测试, 返回 true 表示已经在 namespace 中.
+// 需要 unshare 和 ip 命令, 没有权限创建 namespace 时跳过
+func runInNetns(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(netnsEnv) != "" {
+		return true
+	}
+	unshare, err := exec.LookPath("unshare")
+	if err != nil {
+		t.Skip("unshare not found")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip not found")
+	}
+	if out, err := exec.Command(unshare, "-rn", "true").CombinedOutput(); err != nil {
+		t.Skipf("cannot create network namespace: %v %s", err, out)
+	}
+	cmd := exec.Command(unshare, "-rn", os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	t.Logf("%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return false
+}
+
+func ip(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %v: %v %s", args, err, out)
+	}
+}
+
+// reuseTransparent 没有 iptables 时用本地路由把假 IP 的包交给 0.0.0.0 上的 socket,
+// 需要 SO_REUSEADDR 与同端口的目标和响应 socket 共存
+func reuseTransparent(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1); sockErr != nil {
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipRecvOrigDstAddr, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func listenReuse(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+	lc := net.ListenConfig{Control: reuseTransparent}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*net.UDPConn)
+}
+
+func startUDPEcho(t *testing.T, addr string) {
+	t.Helper()
+	conn := listenReuse(t, addr)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+}
+
+// TestTProxyUDPNetns 在独立的 network namespace 中测试 TPROXY UDP: 应用查询本地 dns 得到假 IP,
+// 发往假 IP 的包由 ServeTProxyUDP 接收, 换回域名后直接发送(经过 Client.Dialer)或经过 Server 转发,
+// 响应以假 IP 为来源发回应用
+func TestTProxyUDPNetns(t *testing.T) {
+	if !runInNetns(t) {
+		return
+	}
+	ip(t, "link", "set", "lo", "up")
+	ip(t, "route", "add", "local", "198.18.0.0/15", "dev", "lo")
+
+	const directPort, proxyPort = 5300, 5301
+	startUDPEcho(t, "127.0.0.1:5300")
+	startUDPEcho(t, "127.0.0.1:5301")
+
+	hosts := dns.NewClient()
+	hosts.Hosts = map[string][]net.IP{
+		"direct.test": {net.ParseIP("127.0.0.1")},
+		"proxy.test":  {net.ParseIP("127.0.0.1")},
+	}
+
+	c := cipher.NewByteMapCipher()
+	srv, err := server.New("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Resolver = hosts
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), l)
+	defer srv.Close()
+
+	rules, err := ruleset.ParseRules([]string{"DOMAIN,direct.test,DIRECT", "MATCH,PROXY"}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := New("", l.Addr().String(), c, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+	clt.Resolver = hosts
+	var mu sync.Mutex
+	var dialed []string
+	clt.Dialer = dialer.Func(func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, network+" "+address)
+		mu.Unlock()
+		return dialer.Direct.DialContext(ctx, network, address)
+	})
+	clt.DNS = &DNSConfig{Listen: "127.0.0.1:0", Remote: []string{"127.0.0.1:1"}, FakeIP: true}
+
+	for _, port := range []int{directPort, proxyPort} {
+		conn := listenReuse(t, (&net.UDPAddr{IP: net.IPv4zero, Port: port}).String())
+		go clt.ServeTProxyUDP(context.Background(), conn)
+	}
+	// ServeTProxyUDP 启动本地 dns 服务器
+	deadline := time.Now().Add(time.Second)
+	for clt.fakeIP.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("fake ip not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	app, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	for _, tc := range []struct {
+		host string
+		port int
+	}{{"direct.test", directPort}, {"proxy.test", proxyPort}} {
+		fake := &net.UDPAddr{IP: clt.fakeIP.Load().Lookup(tc.host), Port: tc.port}
+		if _, err := app.WriteTo([]byte(tc.host), fake); err != nil {
+			t.Fatal(err)
+		}
+		_ = app.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 2048)
+		n, from, err := app.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.host, err)
+		}
+		if string(buf[:n]) != "echo:"+tc.host || from.String() != fake.String() {
+			t.Fatalf("%s: reply %q from %s, want from %s", tc.host, buf[:n], from, fake)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != "udp 127.0.0.1:5300" {
+		t.Fatalf("client dialer dialed %v", dialed)
+	}
+}
+
+// 没有 IP_RECVORIGDSTADDR 的包被丢弃, 不关闭 conn
+func TestTProxyUDPDropsBadPacket(t *testing.T) {
+	clt, err := New("", "127.0.0.1:1", cipher.NewNopCipher(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- clt.ServeTProxyUDP(context.Background(), conn) }()
+
+	app, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := app.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned after a bad packet: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	clt.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve not returned after close")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func ListenTProxy(addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("tproxy is not supported on %s", runtime.GOOS)
+}
+
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("tproxy is not supported on %s", runtime.GOOS)
+}
+
+func listenTProxyReply(dst *net.UDPAddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("tproxy is not supported on %s", runtime.GOOS)
+}
+
+func origDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, fmt.Errorf("tproxy is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// ServeTunnel 把 listener 上的每个连接经过 PROXY 组的 Server 转发到固定的 target(host:port), 不需要 socks5 握手,
+// 也不匹配 ruleset. 用于把远端的数据库等服务映射到本地, 与 Serve 共用 Shutdown/Close. ctx 结束时关闭, 也用于连接 Server
+func (c *Client) ServeTunnel(ctx context.Context, listener net.Listener, target string) error {
+	dst, err := connection.NewAddr(target)
+	if err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	if err := c.start(); err != nil {
+		listener.Close()
+		return errors.Trace(err)
+	}
+	log.Info("Client Tunnel Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()), " -> ", target)
+	return errors.Trace(c.acceptor.Serve(ctx, listener, func(conn net.Conn) {
+		log.Debugf("%s -> %s | %s -> %s tunnel", logger.LocalStr, logger.ClientStr, conn.RemoteAddr(), conn.LocalAddr())
+		if err := c.handleTunnel(ctx, conn, dst); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	}))
+}
+
+func (c *Client) handleTunnel(ctx context.Context, conn net.Conn, dst *connection.Addr) error {
+	defer conn.Close()
+	remote, err := c.proxy.Dial(ctx, dst)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer remote.Close()
+	log.Debugf(
+		"%s <-> %s <-> %s | %s <-> %s(%s) <-> %s",
+		logger.LocalStr, logger.ClientStr, logger.ServerStr,
+		conn.RemoteAddr(), conn.LocalAddr(), remote.LocalAddr(), remote.RemoteAddr(),
+	)
+	return errors.Trace(c.relay(conn, remote))
+}
+
+// ServeTunnelUDP 把 conn 上收到的 UDP 包经过 PROXY 组的 Server 的 UDP relay 转发到固定的 target,
+// 每个来源地址一个会话, 响应从 conn 发回来源. 例如把远端的 dns 服务器映射到本地. ctx 结束时关闭, 也用于连接 Server
+func (c *Client) ServeTunnelUDP(ctx context.Context, conn net.PacketConn, target string) error {
+	dst, err := connection.NewAddr(target)
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	if err := c.start(); err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	log.Info("Client Tunnel UDP Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, conn.LocalAddr()), " -> ", target)
+	return errors.Trace(c.acceptor.ServePacket(ctx, conn, func(conn net.PacketConn) error {
+		return c.serveTunnelUDP(ctx, conn, dst)
+	}))
+}
+
+func (c *Client) serveTunnelUDP(ctx context.Context, conn net.PacketConn, dst *connection.Addr) error {
+	sessions := newUDPSessions()
+	defer sessions.closeAll()
+
+	buf := make([]byte, connection.MaxUDPPacketSize)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		sessions.deliver(src.String(), buf[:n], func(session *udpSession) {
+			defer session.close()
+			remote, err := c.proxy.DialUDP(ctx, dst)
+			if err != nil {
+				log.Debugf("%s -> %s | udp %s -> %s err: %s", logger.LocalStr, logger.ClientStr, src, dst, err)
+				return
+			}
+			out := &tunnelUDP{conn: remote, dst: dst}
+			defer out.Close()
+			c.relayUDP(session, out, conn, src, dst.String())
+		})
+	}
+}
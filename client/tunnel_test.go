@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+)
+
+// recordDialer 直接连接目标, 记录连接的地址
+type recordDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+" "+address)
+	d.mu.Unlock()
+	return dialer.Direct.DialContext(ctx, network, address)
+}
+
+func (d *recordDialer) dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.addrs...)
+}
+
+// newTunnelClient 返回经过本地 Server 转发的 Client 和 Server 使用的 dialer
+func newTunnelClient(t *testing.T) (*Client, *recordDialer) {
+	t.Helper()
+	c := cipher.NewByteMapCipher()
+	d := &recordDialer{}
+	clt, err := New("", startServer(t, c, d), c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clt.Close() })
+	return clt, d
+}
+
+func TestServeTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	clt, d := newTunnelClient(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- clt.ServeTunnel(ctx, l, echo.Addr().String()) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("echo %q", buf)
+	}
+	if got := d.dialed(); len(got) != 1 || got[0] != "tcp "+echo.Addr().String() {
+		t.Fatalf("server dialed %v", got)
+	}
+
+	// ctx 结束时停止服务
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve not returned after ctx canceled")
+	}
+}
+
+func TestServeTunnelUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			sources[from.String()] = true
+			mu.Unlock()
+			echo.WriteTo(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+
+	clt, _ := newTunnelClient(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go clt.ServeTunnelUDP(context.Background(), pc, echo.LocalAddr().String())
+
+	app, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	_ = app.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for _, msg := range []string{"one", "two"} {
+		if _, err := app.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := app.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "echo:"+msg {
+			t.Fatalf("reply %q", buf[:n])
+		}
+	}
+	// 同一个来源的包使用同一个会话, 由 Server 的同一个 UDP relay 发出
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sources) != 1 {
+		t.Fatalf("echo received from %v", sources)
+	}
+	for src := range sources {
+		if src == app.LocalAddr().String() {
+			t.Fatal("packet not relayed")
+		}
+	}
+}
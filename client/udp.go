@@ -0,0 +1,148 @@
+package client
+
+import (
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+)
+
+// 每个 UDP 会话最多缓存的包, 会话还在连接 Server 或者发送太慢时丢弃
+const udpSessionQueue = 64
+
+type udpSession struct {
+	packets   chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	remove    func() // 从 udpSessions 中删除
+}
+
+// close 先从 udpSessions 中删除会话再关闭, 之后收到的包会创建新的会话, 不会交给已经结束的会话
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		s.remove()
+		close(s.done)
+	})
+}
+
+// udpSessions 按 key 把收到的包分发给会话, 会话不存在时创建并在新的 goroutine 中运行
+type udpSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func newUDPSessions() *udpSessions {
+	return &udpSessions{sessions: make(map[string]*udpSession)}
+}
+
+// deliver 复制 packet 交给 key 对应的会话, 会话关闭或 run 返回时删除会话
+func (s *udpSessions) deliver(key string, packet []byte, run func(session *udpSession)) {
+	packet = append([]byte(nil), packet...)
+	s.mu.Lock()
+	session, ok := s.sessions[key]
+	if !ok {
+		session = &udpSession{packets: make(chan []byte, udpSessionQueue), done: make(chan struct{})}
+		session.remove = func() {
+			s.mu.Lock()
+			if s.sessions[key] == session {
+				delete(s.sessions, key)
+			}
+			s.mu.Unlock()
+		}
+		s.sessions[key] = session
+		go func() {
+			defer session.close()
+			run(session)
+		}()
+	}
+	s.mu.Unlock()
+	select {
+	case session.packets <- packet:
+	default:
+	}
+}
+
+func (s *udpSessions) closeAll() {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*udpSession)
+	s.mu.Unlock()
+	for _, session := range sessions {
+		session.close()
+	}
+}
+
+// relayUDP 把 session.packets 发给 out, 把 out 的响应通过 reply 发回 src, 空闲超过 UDPTimeout 时结束.
+// 不关闭 out 和 reply
+func (c *Client) relayUDP(session *udpSession, out udpOutbound, reply net.PacketConn, src net.Addr, dst string) {
+	defer session.close()
+	watchdog := connection.NewWatchdog(c.UDPTimeout, c.MaxSessionDuration, func(reason string) {
+		log.Debugf("%s <-> %s | udp %s <-> %s %s", logger.LocalStr, logger.ClientStr, src, dst, reason)
+		session.close()
+	})
+	defer watchdog.Stop()
+
+	go func() {
+		defer session.close()
+		buf := make([]byte, connection.MaxUDPPacketSize)
+		for {
+			n, err := out.ReadPacket(buf)
+			if err != nil {
+				return
+			}
+			watchdog.Touch()
+			if _, err := reply.WriteTo(buf[:n], src); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case packet := <-session.packets:
+			watchdog.Touch()
+			if err := out.WritePacket(packet); err != nil {
+				log.Debugf("%s -> %s | udp %s -> %s err: %s", logger.LocalStr, logger.ClientStr, src, dst, err)
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// udpOutbound 是 UDP 会话的出站, 目标固定
+type udpOutbound interface {
+	WritePacket(b []byte) error
+	ReadPacket(b []byte) (int, error)
+	Close() error
+}
+
+// directUDP 直接发送, 连接由 Client.Dialer 建立
+type directUDP struct {
+	net.Conn
+}
+
+func (u *directUDP) WritePacket(b []byte) error {
+	_, err := u.Write(b)
+	return err
+}
+
+func (u *directUDP) ReadPacket(b []byte) (int, error) { return u.Read(b) }
+
+// tunnelUDP 经过 Server 的 UDP relay 转发
+type tunnelUDP struct {
+	conn net.Conn
+	dst  *connection.Addr
+}
+
+func (u *tunnelUDP) WritePacket(b []byte) error {
+	return connection.WriteUDPPacket(u.conn, u.dst, b)
+}
+
+func (u *tunnelUDP) ReadPacket(b []byte) (int, error) {
+	_, n, err := connection.ReadUDPPacket(u.conn, b)
+	return n, err
+}
+
+func (u *tunnelUDP) Close() error { return u.conn.Close() }
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUDPSessionsDeliverAfterClose(t *testing.T) {
+	sessions := newUDPSessions()
+	started := make(chan *udpSession, 2)
+	run := func(session *udpSession) {
+		started <- session
+		<-session.done
+	}
+
+	sessions.deliver("k", []byte("1"), run)
+	first := <-started
+	if p := <-first.packets; string(p) != "1" {
+		t.Fatalf("first packet %q", p)
+	}
+	// 会话结束后立即到达的包交给新的会话, 不会被丢弃
+	first.close()
+	sessions.deliver("k", []byte("2"), run)
+	var second *udpSession
+	select {
+	case second = <-started:
+	case <-time.After(time.Second):
+		t.Fatal("no new session after close")
+	}
+	if second == first {
+		t.Fatal("packet delivered to the closed session")
+	}
+	if p := <-second.packets; string(p) != "2" {
+		t.Fatalf("second packet %q", p)
+	}
+
+	sessions.closeAll()
+	select {
+	case <-second.done:
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+	sessions.mu.Lock()
+	n := len(sessions.sessions)
+	sessions.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d sessions left", n)
+	}
+}
@@ -0,0 +1,218 @@
+package connection
+
+import (
+	"context"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxAcceptDelay = time.Second
+
+// Acceptor 在 listener 上接受连接并交给 handler 处理, 记录正在处理的连接以支持关闭:
+// Shutdown 停止接受新连接, 等待正在处理的连接结束, 超时后强制关闭; Close 立即关闭所有连接.
+// 零值可以直接使用
+type Acceptor struct {
+	mu        sync.Mutex
+	listeners map[io.Closer]struct{} // net.Listener 和 net.PacketConn
+	conns     map[net.Conn]struct{}
+	shutdown  bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Serve 阻塞直到 ctx 被取消或调用 Shutdown/Close, 此时返回 nil. ctx 被取消时等同于调用 Close.
+// listener 在别处被关闭或 Accept 返回不可重试的错误时返回错误. 返回时 listener 已被关闭
+func (a *Acceptor) Serve(ctx context.Context, listener net.Listener, handler func(conn net.Conn)) error {
+	defer listener.Close()
+	if !a.trackListener(listener, true) {
+		return nil
+	}
+	defer a.trackListener(listener, false)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.Close()
+		case <-stop:
+		}
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if a.shuttingDown() {
+				return nil
+			}
+			// listener 在别处被关闭, 例如反向隧道的 session 断开
+			if errors.Is(err, net.ErrClosed) || !isTemporary(err) {
+				return errors.Trace(err)
+			}
+			// 例如文件描述符耗尽, 等待一段时间再重试, 避免空转
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Warnf("accept err: %s, retrying in %s", err, delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		delay = 0
+		if !a.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer a.trackConn(conn, false)
+			handler(conn)
+		}()
+	}
+}
+
+func isTemporary(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
+// ServePacket 运行 serve 直到 conn 被关闭, conn 与 listener 一样在 Shutdown/Close 时被关闭, 此时返回 nil.
+// serve 需要在 conn 被关闭后返回
+func (a *Acceptor) ServePacket(ctx context.Context, conn net.PacketConn, serve func(conn net.PacketConn) error) error {
+	if !a.trackListener(conn, true) {
+		conn.Close()
+		return nil
+	}
+	defer a.trackListener(conn, false)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.Close()
+		case <-stop:
+		}
+	}()
+	err := serve(conn)
+	if a.shuttingDown() {
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// Shutdown 停止接受新连接并等待正在处理的连接结束, ctx 结束时强制关闭剩下的连接并返回 ctx.Err()
+func (a *Acceptor) Shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	a.setShutdown()
+	for listener := range a.listeners {
+		listener.Close()
+	}
+	a.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		a.Close()
+		<-done
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// Close 停止接受新连接并立即关闭所有连接, 不等待连接处理结束
+func (a *Acceptor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.setShutdown()
+	for listener := range a.listeners {
+		listener.Close()
+	}
+	for conn := range a.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// Closed 返回是否已经调用过 Shutdown/Close
+func (a *Acceptor) Closed() bool { return a.shuttingDown() }
+
+// ShutdownChan 在调用 Shutdown/Close 时被关闭, 长时间运行的 handler 可以据此主动结束,
+// 例如多路复用的 session 不再接受新的 stream
+func (a *Acceptor) ShutdownChan() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.doneChan()
+}
+
+// setShutdown 需要持有 mu
+func (a *Acceptor) setShutdown() {
+	if !a.shutdown {
+		a.shutdown = true
+		close(a.doneChan())
+	}
+}
+
+func (a *Acceptor) doneChan() chan struct{} {
+	if a.done == nil {
+		a.done = make(chan struct{})
+	}
+	return a.done
+}
+
+func (a *Acceptor) shuttingDown() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.shutdown
+}
+
+func (a *Acceptor) trackListener(listener io.Closer, add bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !add {
+		delete(a.listeners, listener)
+		return true
+	}
+	if a.shutdown {
+		return false
+	}
+	if a.listeners == nil {
+		a.listeners = make(map[io.Closer]struct{})
+	}
+	a.listeners[listener] = struct{}{}
+	return true
+}
+
+// trackConn 在同一把锁下检查 shutdown 和 wg.Add, 保证 Shutdown 开始等待后不会再增加连接
+func (a *Acceptor) trackConn(conn net.Conn, add bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !add {
+		delete(a.conns, conn)
+		a.wg.Done()
+		return true
+	}
+	if a.shutdown {
+		return false
+	}
+	if a.conns == nil {
+		a.conns = make(map[net.Conn]struct{})
+	}
+	a.conns[conn] = struct{}{}
+	a.wg.Add(1)
+	return true
+}
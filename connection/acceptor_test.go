@@ -0,0 +1,167 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeListener 是内存中的 listener, dial 返回 net.Pipe 的一端
+type pipeListener struct {
+	conns     chan net.Conn
+	errs      chan error
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), errs: make(chan error, 1), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "pipe"} }
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- c2:
+		return c1, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func serveEcho(a *Acceptor, ctx context.Context, l net.Listener) <-chan error {
+	served := make(chan error, 1)
+	go func() {
+		served <- a.Serve(ctx, l, func(conn net.Conn) {
+			defer conn.Close()
+			buf := make([]byte, 1)
+			if _, err := conn.Read(buf); err == nil {
+				conn.Write(buf)
+			}
+		})
+	}()
+	return served
+}
+
+func waitServed(t *testing.T, served <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-served:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve did not return")
+		return nil
+	}
+}
+
+func TestAcceptorClose(t *testing.T) {
+	var a Acceptor
+	l := newPipeListener()
+	served := serveEcho(&a, context.Background(), l)
+
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{1})
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Close()
+	if err := waitServed(t, served); err != nil {
+		t.Fatalf("serve returned %v", err)
+	}
+	if !l.closed() {
+		t.Fatal("listener not closed")
+	}
+	// Close 之后 Serve 立即返回
+	l2 := newPipeListener()
+	if err := waitServed(t, serveEcho(&a, context.Background(), l2)); err != nil || !l2.closed() {
+		t.Fatalf("serve after close returned %v", err)
+	}
+}
+
+func TestAcceptorContext(t *testing.T) {
+	var a Acceptor
+	l := newPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := serveEcho(&a, ctx, l)
+	cancel()
+	if err := waitServed(t, served); err != nil {
+		t.Fatalf("serve returned %v", err)
+	}
+	if !l.closed() {
+		t.Fatal("listener not closed")
+	}
+}
+
+func TestAcceptorListenerClosed(t *testing.T) {
+	var a Acceptor
+	l := newPipeListener()
+	served := serveEcho(&a, context.Background(), l)
+	l.Close()
+	if err := waitServed(t, served); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("serve returned %v", err)
+	}
+}
+
+func TestAcceptorAcceptError(t *testing.T) {
+	var a Acceptor
+	l := newPipeListener()
+	served := serveEcho(&a, context.Background(), l)
+
+	// 临时错误重试
+	l.errs <- tempError{}
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// 其他错误返回, 并关闭 listener
+	fatal := errors.New("fatal")
+	l.errs <- fatal
+	if err := waitServed(t, served); !errors.Is(err, fatal) {
+		t.Fatalf("serve returned %v", err)
+	}
+	if !l.closed() {
+		t.Fatal("listener not closed")
+	}
+}
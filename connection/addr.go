@@ -0,0 +1,94 @@
+package connection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// Addr 是 socks5 协议中的目标地址: ATYP | DST.ADDR | DST.PORT
+type Addr struct {
+	Host string // ATYP 为 DOMAINNAME 时的域名, 否则为空
+	IP   net.IP
+	Port int
+}
+
+// ParseAddr 从 ATYP 开始解析地址, 返回地址和占用的字节数
+func ParseAddr(b []byte) (*Addr, int, error) {
+	if len(b) < 1 {
+		return nil, 0, fmt.Errorf("empty addr")
+	}
+	addr := &Addr{}
+	var n int
+	switch ATYP := b[0]; ATYP {
+	case AtypIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			return nil, 0, fmt.Errorf("short ipv4 addr: %d", len(b))
+		}
+		addr.IP = net.IP(append([]byte(nil), b[1:n]...))
+	case AtypDomain:
+		if len(b) < 2 {
+			return nil, 0, fmt.Errorf("short domain addr: %d", len(b))
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return nil, 0, fmt.Errorf("short domain addr: %d", len(b))
+		}
+		addr.Host = string(b[2:n])
+	case AtypIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			return nil, 0, fmt.Errorf("short ipv6 addr: %d", len(b))
+		}
+		addr.IP = net.IP(append([]byte(nil), b[1:n]...))
+	default:
+		return nil, 0, fmt.Errorf("no such ATYP: %d", ATYP)
+	}
+	addr.Port = int(binary.BigEndian.Uint16(b[n : n+2]))
+	return addr, n + 2, nil
+}
+
+// NewAddr 由 host:port 构造地址, host 不是 IP 时按域名处理
+func NewAddr(hostport string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 0xffff {
+		return nil, fmt.Errorf("invalid port: %s", port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &Addr{IP: ip, Port: p}, nil
+	}
+	return &Addr{Host: host, Port: p}, nil
+}
+
+func (a *Addr) Bytes() []byte {
+	var b []byte
+	switch {
+	case a.Host != "":
+		b = append([]byte{AtypDomain, byte(len(a.Host))}, a.Host...)
+	case a.IP.To4() != nil:
+		b = append([]byte{AtypIPv4}, a.IP.To4()...)
+	default:
+		b = append([]byte{AtypIPv6}, a.IP.To16()...)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port))
+}
+
+func (a *Addr) String() string {
+	host := a.Host
+	if host == "" {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
@@ -0,0 +1,21 @@
+package connection
+
+import (
+	"bufio"
+	"net"
+)
+
+// BufferedConn 先读取 r 中已经缓存的数据再读取 Conn, 用于握手时预读了数据的连接
+type BufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewBufferedConn r 必须是从 conn 读取的 bufio.Reader
+func NewBufferedConn(conn net.Conn, r *bufio.Reader) *BufferedConn {
+	return &BufferedConn{Conn: conn, r: r}
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *BufferedConn) CloseWrite() error { return CloseWrite(c.Conn) }
@@ -0,0 +1,47 @@
+package connection
+
+import (
+	"net"
+)
+
+var _ net.Conn = (*PlainConn)(nil)
+
+// PlainConn 是 SecureSocket 的明文视图: Read 时解密, Write 时加密
+type PlainConn struct {
+	*SecureSocket
+	pending []byte
+}
+
+func NewPlainConn(ss *SecureSocket) *PlainConn {
+	return &PlainConn{SecureSocket: ss}
+}
+
+func (c *PlainConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		buf := GetBuffer()
+		defer PutBuffer(buf)
+		n, err := c.Conn.Read(buf)
+		if n == 0 {
+			return 0, err
+		}
+		data, decErr := c.cipher.Decrypt(buf[:n])
+		if decErr != nil {
+			return 0, decErr
+		}
+		c.pending = data
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *PlainConn) Write(b []byte) (int, error) {
+	data, err := c.cipher.Encrypt(b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
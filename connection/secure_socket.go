@@ -8,6 +8,8 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,20 +17,25 @@ const (
 	ConnResetByPeerErr = "connection reset by peer"
 )
 
-var recoverableNetError = errors.New("recoverable net error")
+var (
+	recoverableNetError   = errors.New("recoverable net error")
+	halfCloseNotSupported = errors.New("half-close not supported")
+)
+
+// LingerTimeout 隧道一个方向结束并关闭另一端的写方向后, 等待另一个方向结束的最长时间
+var LingerTimeout = 30 * time.Second
 
 type SecureSocket struct {
 	net.Conn
 	cipher cipher.Cipher
 
-	closeFlag bool
+	closeFlag int32
 }
 
 func NewSecureSocket(conn net.Conn, cipher cipher.Cipher) *SecureSocket {
 	ss := &SecureSocket{
-		Conn:      conn,
-		cipher:    cipher,
-		closeFlag: false,
+		Conn:   conn,
+		cipher: cipher,
 	}
 	return ss
 }
@@ -38,13 +45,15 @@ func (ss *SecureSocket) Hijack() net.Conn {
 }
 
 func (ss *SecureSocket) Close() (err error) {
-	if ss == nil || ss.closeFlag {
+	if ss == nil || !atomic.CompareAndSwapInt32(&ss.closeFlag, 0, 1) {
 		return
 	}
-	if err = ss.Conn.Close(); err == nil {
-		ss.closeFlag = true
-	}
-	return
+	return ss.Conn.Close()
+}
+
+// CloseWrite 关闭写方向, 底层连接不支持时返回错误
+func (ss *SecureSocket) CloseWrite() error {
+	return CloseWrite(ss.Conn)
 }
 
 func (ss *SecureSocket) DecryptTo(to io.Writer) error {
@@ -59,6 +68,10 @@ func (ss *SecureSocket) DecryptToBytes(to []byte) (int, error) {
 	return DecryptToBytes(ss, to)
 }
 
+func (ss *SecureSocket) DecryptFull(to []byte) error {
+	return DecryptFull(ss, to)
+}
+
 func (ss *SecureSocket) EncryptFromBytes(from []byte) (int, error) {
 	return EncryptFromBytes(from, ss)
 }
@@ -124,6 +137,28 @@ func DecryptToBytes(from *SecureSocket, to []byte) (int, error) {
 	return len(temp), err
 }
 
+// DecryptFull 读取对端一次加密的 len(to) 字节并解密到 to, 不会多读对端紧接着发送的数据.
+// 先用 cipher 计算 len(to) 字节加密后的长度, 再读取恰好这么多的密文
+func DecryptFull(from *SecureSocket, to []byte) error {
+	probe, err := from.cipher.Encrypt(make([]byte, len(to)))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	buf := make([]byte, len(probe))
+	if _, err := io.ReadFull(from.Conn, buf); err != nil {
+		return handlerNetError(err)
+	}
+	data, err := from.cipher.Decrypt(buf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(data) != len(to) {
+		return fmt.Errorf("decrypt %d bytes, want %d", len(data), len(to))
+	}
+	copy(to, data)
+	return nil
+}
+
 // from --(encrypt)--> to
 func EncryptFromBytes(from []byte, to *SecureSocket) (int, error) {
 	encryptData, err := to.cipher.Encrypt(from)
@@ -137,52 +172,82 @@ func EncryptFromBytes(from []byte, to *SecureSocket) (int, error) {
 	return len(from), nil
 }
 
-// join plainConn and cipherConn, block until error occurs:
+// join plainConn and cipherConn, block until both directions finish or error occurs:
 // plain ---(encrypt)--> cipher
 // plain <--(decrypt)--- cipher
 func Tunnel(cipher, plain *SecureSocket) error {
-	errChan := make(chan error, 2)
-	pipe := func(cipherFunc cipherFunc, from, to *SecureSocket) {
-		defer to.Close()
-		defer from.Close()
-		if err := cipherFunc(from, to); err != nil {
-			if err == recoverableNetError {
-				//log.Debug(errors.Trace(err))
-			} else {
-				errChan <- errors.Trace(err)
+	pipe := func(cipherFunc cipherFunc, from, to *SecureSocket) func() error {
+		return func() error {
+			if err := cipherFunc(from, to); err != recoverableNetError {
+				return err
 			}
+			return nil
 		}
 	}
-
-	go pipe(Decrypt, cipher, plain)
-	go pipe(Encrypt, plain, cipher)
-	// ignore second error
-	return <-errChan
+	return errors.Trace(join(cipher, plain, pipe(Decrypt, cipher, plain), pipe(Encrypt, plain, cipher)))
 }
 
-// join two conn, block until error occurs
+// join two conn, block until both directions finish or error occurs
 func Copy(c1, c2 net.Conn) error {
+	pipe := func(to, from net.Conn) func() error {
+		return func() error {
+			_, err := io.Copy(to, from)
+			return ignoreNetError(err)
+		}
+	}
+	return errors.Trace(join(c1, c2, pipe(c2, c1), pipe(c1, c2)))
+}
+
+// join 同时运行两个方向: aToB 把 a 读到的数据写到 b, bToA 相反, 返回 nil 表示读到了 EOF.
+// 一个方向读到 EOF 时关闭另一端的写方向(half-close), 另一个方向继续传输, 最多再等待 LingerTimeout.
+// 出错或不支持 half-close 时立即关闭两端
+func join(a, b net.Conn, aToB, bToA func() error) error {
 	errChan := make(chan error, 2)
-	pipe := func(c1, c2 net.Conn) {
-		defer c1.Close()
-		defer c2.Close()
-		_, err := io.Copy(c1, c2)
-		err = ignoreNetError(err)
-		if err != nil {
-			errChan <- errors.Trace(err)
+	run := func(pipe func() error, to net.Conn) {
+		err := pipe()
+		if err == nil && CloseWrite(to) == nil {
+			errChan <- nil
+			return
 		}
+		a.Close()
+		b.Close()
+		errChan <- err
+	}
+	go run(aToB, b)
+	go run(bToA, a)
+	defer b.Close()
+	defer a.Close()
+
+	if err := <-errChan; err != nil {
+		return err
 	}
+	timer := time.NewTimer(LingerTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-errChan:
+		return err
+	case <-timer.C:
+		return nil
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
 
-	go pipe(c1, c2)
-	go pipe(c2, c1)
-	return <-errChan
+// CloseWrite 关闭 conn 的写方向, conn 不支持 half-close 时返回错误
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return halfCloseNotSupported
 }
 
 func handlerNetError(err error) error {
 	if err == nil {
 		return nil
 	}
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe {
 		return recoverableNetError
 	}
 	if e, ok := err.(*net.OpError); ok && strings.Contains(e.Err.Error(), UseClosedConnErr) {
@@ -195,11 +260,16 @@ func handlerNetError(err error) error {
 	return errors.Trace(err)
 }
 
+// IsRecoverableNetError 判断 err 是否是对端关闭连接之类不需要报错的网络错误
+func IsRecoverableNetError(err error) bool {
+	return errors.Cause(err) == recoverableNetError
+}
+
 func ignoreNetError(err error) error {
 	if err == nil {
 		return nil
 	}
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe {
 		return nil
 	}
 	if e, ok := err.(*net.OpError); ok && strings.Contains(e.Err.Error(), UseClosedConnErr) {
@@ -0,0 +1,122 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair 返回一对相连的 tcp 连接, 支持 half-close
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+// startCopy 在 client 和 server 之间用 Copy 转发, 返回 client 和 server 一端, 以及 Copy 的结果
+func startCopy(t *testing.T) (client, server *net.TCPConn, a, b *net.TCPConn, done <-chan error) {
+	t.Helper()
+	client, a = tcpPair(t)
+	b, server = tcpPair(t)
+	errChan := make(chan error, 1)
+	go func() { errChan <- Copy(a, b) }()
+	return client, server, a, b, errChan
+}
+
+func TestCopyHalfClose(t *testing.T) {
+	client, server, _, _, done := startCopy(t)
+	reply := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	// 像 HTTP/1.0 一样, client 发送请求后关闭写方向, server 读到 EOF 后才回复
+	go func() {
+		defer server.Close()
+		req, err := io.ReadAll(server)
+		if err != nil || string(req) != "GET / HTTP/1.0\r\n\r\n" {
+			return
+		}
+		server.Write(reply)
+	}()
+	if _, err := client.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, reply) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(reply))
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("copy not finished")
+	}
+}
+
+func TestCopyLingerTimeout(t *testing.T) {
+	defer func(d time.Duration) { LingerTimeout = d }(LingerTimeout)
+	LingerTimeout = 100 * time.Millisecond
+
+	client, server, a, b, done := startCopy(t)
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// server 收到 EOF 后既不回复也不关闭
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("server read %v, want EOF", err)
+	}
+
+	start := time.Now()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("copy not finished after LingerTimeout")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("copy finished after %s", d)
+	}
+	for _, conn := range []net.Conn{a, b} {
+		if _, err := conn.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("write after linger: %v", err)
+		}
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read %v, want EOF", err)
+	}
+}
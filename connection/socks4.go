@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"io"
+	"net"
+)
+
+const (
+	Socks4Granted  = 0x5a
+	Socks4Rejected = 0x5b
+)
+
+// USERID 和 socks4a 域名的最大长度
+const maxSocks4String = 255
+
+// ReadSocks4Request 读取 socks4/4a CONNECT request, 返回目标和 USERID. 不支持 BIND
+func ReadSocks4Request(r io.Reader) (dst *Addr, userID string, err error) {
+	/**
+	  +----+----+----+----+----+----+----+----+----+----+....+----+
+	  | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+	  +----+----+----+----+----+----+----+----+----+----+....+----+
+	     1    1      2              4           variable       1
+	*/
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	if VN := header[0]; VN != 0x04 {
+		return nil, "", fmt.Errorf("error socks4 VN: %d", VN)
+	}
+	if CD := header[1]; CD != CmdConnect {
+		return nil, "", fmt.Errorf("error socks4 CD: %d", CD)
+	}
+	if userID, err = readCString(r); err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	dst = &Addr{
+		IP:   net.IP(append([]byte(nil), header[4:8]...)),
+		Port: int(binary.BigEndian.Uint16(header[2:4])),
+	}
+	// socks4a: DSTIP 为 0.0.0.x(x 不为 0) 时 USERID 之后是以 NULL 结尾的域名, 由代理解析
+	if ip := dst.IP; ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if dst.Host, err = readCString(r); err != nil {
+			return nil, "", errors.Trace(err)
+		}
+		if dst.Host == "" {
+			return nil, "", fmt.Errorf("empty socks4a host")
+		}
+		dst.IP = nil
+	}
+	return dst, userID, nil
+}
+
+// ReplySocks4 响应 socks4 request, code 为 Socks4Granted 或 Socks4Rejected
+func ReplySocks4(w io.Writer, code byte) error {
+	/**
+	  +----+----+----+----+----+----+----+----+
+	  | VN | CD | DSTPORT |      DSTIP        |
+	  +----+----+----+----+----+----+----+----+
+	     1    1      2              4
+	*/
+	if _, err := w.Write([]byte{0x00, code, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// readCString 逐字节读取以 NULL 结尾的字符串, r 通常是带缓冲的连接
+func readCString(r io.Reader) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", errors.Trace(err)
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == maxSocks4String {
+			return "", fmt.Errorf("socks4 string too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
@@ -0,0 +1,89 @@
+package connection
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func socks4Request(port int, ip []byte, userID string, host string) []byte {
+	req := []byte{0x04, CmdConnect, byte(port >> 8), byte(port)}
+	req = append(req, ip...)
+	req = append(append(req, userID...), 0)
+	if host != "" {
+		req = append(append(req, host...), 0)
+	}
+	return req
+}
+
+func TestReadSocks4Request(t *testing.T) {
+	long := strings.Repeat("a", maxSocks4String)
+	for _, tc := range []struct {
+		name   string
+		req    []byte
+		dst    string
+		userID string
+		err    bool
+	}{
+		{name: "ipv4", req: socks4Request(80, []byte{192, 0, 2, 1}, "", ""), dst: "192.0.2.1:80"},
+		{name: "userid", req: socks4Request(443, []byte{192, 0, 2, 1}, "alice", ""), dst: "192.0.2.1:443", userID: "alice"},
+		{name: "socks4a", req: socks4Request(8080, []byte{0, 0, 0, 1}, "bob", "example.com"), dst: "example.com:8080", userID: "bob"},
+		// 0.0.0.0 不是 socks4a
+		{name: "zero ip", req: socks4Request(80, []byte{0, 0, 0, 0}, "", ""), dst: "0.0.0.0:80"},
+		{name: "max userid", req: socks4Request(80, []byte{192, 0, 2, 1}, long, ""), dst: "192.0.2.1:80", userID: long},
+		{name: "max host", req: socks4Request(80, []byte{0, 0, 0, 9}, "", long), dst: long + ":80"},
+		{name: "long userid", req: socks4Request(80, []byte{192, 0, 2, 1}, long+"a", ""), err: true},
+		{name: "long host", req: socks4Request(80, []byte{0, 0, 0, 1}, "", long+"a"), err: true},
+		{name: "empty host", req: append(socks4Request(80, []byte{0, 0, 0, 1}, "", ""), 0), err: true},
+		{name: "socks5", req: []byte{0x05, CmdConnect, 0, 80, 192, 0, 2, 1, 0}, err: true},
+		{name: "bind", req: []byte{0x04, CmdBind, 0, 80, 192, 0, 2, 1, 0}, err: true},
+		{name: "no null", req: []byte{0x04, CmdConnect, 0, 80, 192, 0, 2, 1, 'u'}, err: true},
+		{name: "short", req: []byte{0x04, CmdConnect, 0, 80}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			go func() {
+				defer c1.Close()
+				// 请求之后紧接着的数据留给调用者
+				c1.Write(append(tc.req, "data"...))
+			}()
+			dst, userID, err := ReadSocks4Request(c2)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("parsed %s %q", dst, userID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dst.String() != tc.dst || userID != tc.userID {
+				t.Fatalf("parsed %s %q, want %s %q", dst, userID, tc.dst, tc.userID)
+			}
+			if rest, _ := io.ReadAll(c2); string(rest) != "data" {
+				t.Fatalf("left %q", rest)
+			}
+		})
+	}
+}
+
+func TestReplySocks4(t *testing.T) {
+	for _, code := range []byte{Socks4Granted, Socks4Rejected} {
+		c1, c2 := net.Pipe()
+		go func() {
+			defer c1.Close()
+			ReplySocks4(c1, code)
+		}()
+		reply, err := io.ReadAll(c2)
+		c2.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte{0x00, code, 0, 0, 0, 0, 0, 0}; !bytes.Equal(reply, want) {
+			t.Fatalf("reply %v, want %v", reply, want)
+		}
+	}
+}
@@ -1,13 +1,34 @@
 package connection
 
 import (
-	"encoding/binary"
 	"fmt"
 	"github.com/juju/errors"
 	"net"
 )
 
+const (
+	MethodNoAuth = 0x00
+	// MethodUserPass 是 RFC 1929 的用户名/密码认证
+	MethodUserPass = 0x02
+	// MethodNoAcceptable 表示没有可以接受的 method, 客户端收到后关闭连接
+	MethodNoAcceptable = 0xFF
+	// MethodMux 是私有的 method(X'80' to X'FE'), 协商成功后连接切换为多路复用
+	MethodMux = 0x80
+)
+
 func HandShakeHandler(conn *SecureSocket) (received []byte, err error) {
+	if received, _, err = ReadHandshake(conn); err != nil {
+		return received, errors.Trace(err)
+	}
+	// 不需要验证，直接验证通过
+	if err := ReplyHandshake(conn, MethodNoAuth); err != nil {
+		return received, errors.Trace(err)
+	}
+	return received, nil
+}
+
+// ReadHandshake 读取 socks5 握手, 返回客户端支持的 METHODS
+func ReadHandshake(conn *SecureSocket) (received, methods []byte, err error) {
 	received = make([]byte, 256)
 	/**
 	   The localConn connects to the dstServer, and sends a ver
@@ -23,16 +44,26 @@ func HandShakeHandler(conn *SecureSocket) (received []byte, err error) {
 	*/
 	n, err := conn.DecryptToBytes(received)
 	if err != nil {
-		return received, errors.Trace(err)
+		return received, nil, errors.Trace(err)
 	}
 	received = received[:n]
+	if n < 2 {
+		return received, nil, fmt.Errorf("error handshake n: %d", n)
+	}
 
 	// 第一个字段VER代表Socks的版本，Socks5默认为0x05，其固定长度为1个字节
 	// 只支持版本5
 	if VER := received[0]; VER != 0x05 {
-		return received, fmt.Errorf("support sock5 only")
+		return received, nil, fmt.Errorf("support sock5 only")
 	}
+	methods = received[2:]
+	if NMETHODS := int(received[1]); NMETHODS < len(methods) {
+		methods = methods[:NMETHODS]
+	}
+	return received, methods, nil
+}
 
+func ReplyHandshake(conn *SecureSocket, method byte) error {
 	/**
 	   The dstServer selects from one of the methods given in METHODS, and
 	   sends a METHOD selection message:
@@ -42,15 +73,91 @@ func HandShakeHandler(conn *SecureSocket) (received []byte, err error) {
 		          | 1  |   1    |
 		          +----+--------+
 	*/
-	// 不需要验证，直接验证通过
-	resp := []byte{0x05, 0x00}
-	if _, err := conn.EncryptFromBytes(resp); err != nil {
-		return received, errors.Trace(err)
+	if _, err := conn.EncryptFromBytes([]byte{0x05, method}); err != nil {
+		return errors.Trace(err)
 	}
-	return received, nil
+	return nil
 }
 
-func RequestHandler(conn *SecureSocket) (dst *net.TCPConn, received []byte, err error) {
+const (
+	UserPassSucceeded = 0x00
+	UserPassFailed    = 0x01
+)
+
+// ReadUserPass 读取 RFC 1929 的用户名/密码认证请求, 按长度读取, 不会多读之后的 request
+func ReadUserPass(conn *SecureSocket) (username, password string, err error) {
+	/**
+	  +----+------+----------+------+----------+
+	  |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	  +----+------+----------+------+----------+
+	  | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	  +----+------+----------+------+----------+
+	*/
+	header := make([]byte, 2)
+	if err = conn.DecryptFull(header); err != nil {
+		return "", "", errors.Trace(err)
+	}
+	// 子协商的版本固定为 0x01
+	if VER := header[0]; VER != 0x01 {
+		return "", "", fmt.Errorf("error user/pass VER: %d", VER)
+	}
+	// UNAME 之后紧接着 PLEN
+	uname := make([]byte, int(header[1])+1)
+	if err = conn.DecryptFull(uname); err != nil {
+		return "", "", errors.Trace(err)
+	}
+	passwd := make([]byte, int(uname[len(uname)-1]))
+	if err = conn.DecryptFull(passwd); err != nil {
+		return "", "", errors.Trace(err)
+	}
+	return string(uname[:len(uname)-1]), string(passwd), nil
+}
+
+// ReplyUserPass 响应用户名/密码认证, status 为 UserPassSucceeded 或 UserPassFailed
+func ReplyUserPass(conn *SecureSocket, status byte) error {
+	/**
+	  +----+--------+
+	  |VER | STATUS |
+	  +----+--------+
+	  | 1  |   1    |
+	  +----+--------+
+	*/
+	if _, err := conn.EncryptFromBytes([]byte{0x01, status}); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+const (
+	RepSucceeded           = 0x00
+	RepGeneralFailure      = 0x01
+	RepNotAllowed          = 0x02
+	RepHostUnreachable     = 0x04
+	RepCommandNotSupported = 0x07
+)
+
+const (
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+)
+
+// ReadRequest 读取并解析 socks5 CONNECT request, 不连接目标
+func ReadRequest(conn *SecureSocket) (received []byte, dst *Addr, err error) {
+	received, cmd, dst, err := ReadCommand(conn)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if cmd != CmdConnect {
+		return nil, nil, fmt.Errorf("error CMD: %d", cmd)
+	}
+	return received, dst, nil
+}
+
+// ReadCommand 读取并解析 socks5 request, 支持 CONNECT, BIND 和 UDP ASSOCIATE.
+// 隧道中的 UDP ASSOCIATE 表示之后在同一个连接上收发 UDP 包, 格式见 WriteUDPPacket;
+// mux stream 中的 BIND 表示注册反向隧道, 由 Server 监听 DST.ADDR
+func ReadCommand(conn *SecureSocket) (received []byte, cmd byte, dst *Addr, err error) {
 	/**
 	  +----+-----+-------+------+----------+----------+
 	  |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
@@ -72,37 +179,54 @@ func RequestHandler(conn *SecureSocket) (dst *net.TCPConn, received []byte, err
 	received = received[:n]
 
 	// CMD代表客户端请求的类型，值长度也是1个字节，有三种类型
-	// CONNECT X'01',目前只支持 CONNECT
-	if CMD := received[1]; CMD != 0x01 {
-		err = fmt.Errorf("error CMD: %d", received[1])
+	// CONNECT X'01', BIND X'02', UDP ASSOCIATE X'03'
+	switch cmd = received[1]; cmd {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+	default:
+		err = fmt.Errorf("error CMD: %d", cmd)
 		return
 	}
 
-	var dIP []byte
 	// aType 代表请求的远程服务器地址类型，值长度1个字节，有三种类型
-	switch ATYP := received[3]; ATYP {
-	case 0x01:
-		//	IP V4 address: X'01'
-		dIP = received[4 : 4+net.IPv4len]
-	case 0x03:
-		//	DOMAINNAME: X'03'
-		ipAddr, err := net.ResolveIPAddr("ip", string(received[5:n-2]))
+	if dst, _, err = ParseAddr(received[3:]); err != nil {
+		err = errors.Trace(err)
+		return
+	}
+	return
+}
+
+// ReplyRequest 响应 socks5 request
+func ReplyRequest(conn *SecureSocket, rep byte) error {
+	/**
+	  +----+-----+-------+------+----------+----------+
+	  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	  +----+-----+-------+------+----------+----------+
+	  | 1  |  1  | X'00' |  1   | Variable |    2     |
+	  +----+-----+-------+------+----------+----------+
+	*/
+	if _, err := conn.EncryptFromBytes([]byte{0x05, rep, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func RequestHandler(conn *SecureSocket) (dst *net.TCPConn, received []byte, err error) {
+	received, addr, err := ReadRequest(conn)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	dIP := addr.IP
+	if dIP == nil {
+		ipAddr, err := net.ResolveIPAddr("ip", addr.Host)
 		if err != nil {
 			return nil, nil, errors.Trace(err)
 		}
 		dIP = ipAddr.IP
-	case 0x04:
-		//	IP V6 address: X'04'
-		dIP = received[4 : 4+net.IPv6len]
-	default:
-		err = fmt.Errorf("no such ATYP: %d", received[3])
-		return
 	}
-
-	dPort := received[n-2 : n]
 	dstAddr := &net.TCPAddr{
 		IP:   dIP,
-		Port: int(binary.BigEndian.Uint16(dPort)),
+		Port: addr.Port,
 	}
 
 	dst, err = net.DialTCP("tcp", nil, dstAddr)
@@ -113,15 +237,7 @@ func RequestHandler(conn *SecureSocket) (dst *net.TCPConn, received []byte, err
 	dst.SetLinger(0)
 
 	// 响应客户端连接成功
-	/**
-	  +----+-----+-------+------+----------+----------+
-	  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
-	  +----+-----+-------+------+----------+----------+
-	  | 1  |  1  | X'00' |  1   | Variable |    2     |
-	  +----+-----+-------+------+----------+----------+
-	*/
-	// 响应客户端连接成功
-	if _, err := conn.EncryptFromBytes([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
+	if err := ReplyRequest(conn, RepSucceeded); err != nil {
 		return nil, nil, errors.Trace(err)
 	}
 	return
@@ -141,24 +257,56 @@ func GetSock5Data(from *SecureSocket) (
 	return
 }
 
+// NewRequest 构造 CONNECT dst 的 socks5 request
+func NewRequest(dst *Addr) []byte {
+	return append([]byte{0x05, CmdConnect, 0x00}, dst.Bytes()...)
+}
+
+// NewUDPRequest 构造 UDP ASSOCIATE 的 socks5 request, dst 是第一个包的目标, Server 只用于记录
+func NewUDPRequest(dst *Addr) []byte {
+	return append([]byte{0x05, CmdUDPAssociate, 0x00}, dst.Bytes()...)
+}
+
+// NewBindRequest 构造 BIND 的 socks5 request, 请求 Server 在 addr 上监听反向隧道
+func NewBindRequest(addr *Addr) []byte {
+	return append([]byte{0x05, CmdBind, 0x00}, addr.Bytes()...)
+}
+
 func SendSocks5Data(serverConn *SecureSocket, handshakeReceived, requestReceived []byte) error {
-	if _, err := serverConn.EncryptFromBytes(handshakeReceived); err != nil {
+	if err := SendHandshake(serverConn, handshakeReceived); err != nil {
 		return errors.Trace(err)
 	}
-	buf := make([]byte, 256)
-	if _, err := serverConn.DecryptToBytes(buf); err != nil {
+	return errors.Trace(SendRequest(serverConn, requestReceived))
+}
+
+// SendHandshake 发送 socks5 握手, Server 需要选择 MethodNoAuth.
+// 只读取 2 字节的响应, 之后的数据留给调用者
+func SendHandshake(serverConn *SecureSocket, handshake []byte) error {
+	if _, err := serverConn.EncryptFromBytes(handshake); err != nil {
+		return errors.Trace(err)
+	}
+	buf := make([]byte, 2)
+	if err := serverConn.DecryptFull(buf); err != nil {
 		return errors.Trace(err)
 	}
 	if buf[0] != 0x05 || buf[1] != 0x00 {
 		return fmt.Errorf("error handshake resp: %b %b", buf[0], buf[1])
 	}
-	if _, err := serverConn.EncryptFromBytes(requestReceived); err != nil {
+	return nil
+}
+
+// SendRequest 发送 socks5 request, Server 需要响应连接成功.
+// 只读取 10 字节的响应, 不会多读 Server 紧接着转发的目标数据, 例如 SSH/SMTP 的 banner
+func SendRequest(serverConn *SecureSocket, request []byte) error {
+	if _, err := serverConn.EncryptFromBytes(request); err != nil {
 		return errors.Trace(err)
 	}
-	if _, err := serverConn.DecryptToBytes(buf); err != nil {
+	// Server 总是用 ReplyRequest 响应, BND 为 IPv4 0.0.0.0:0
+	buf := make([]byte, 10)
+	if err := serverConn.DecryptFull(buf); err != nil {
 		return errors.Trace(err)
 	}
-	if string(buf[:10]) != string([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) {
+	if string(buf) != string([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) {
 		return fmt.Errorf("error request resp: %b", buf)
 	}
 	return nil
@@ -0,0 +1,108 @@
+package connection
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Watchdog 在连接空闲超过 idle 或存活超过 lifetime 时调用一次 expire, 0 表示不限制.
+// 通过 WatchConn 包装的连接每次读写都会重新计算空闲时间
+type Watchdog struct {
+	idle   time.Duration
+	expire func(reason string)
+
+	lastActive int64 // unix nano
+
+	mu        sync.Mutex
+	stopped   bool
+	idleTimer *time.Timer
+	lifeTimer *time.Timer
+}
+
+func NewWatchdog(idle, lifetime time.Duration, expire func(reason string)) *Watchdog {
+	w := &Watchdog{idle: idle, expire: expire}
+	w.Touch()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if idle > 0 {
+		w.idleTimer = time.AfterFunc(idle, w.checkIdle)
+	}
+	if lifetime > 0 {
+		w.lifeTimer = time.AfterFunc(lifetime, func() { w.fire("max session duration exceeded") })
+	}
+	return w
+}
+
+func (w *Watchdog) Touch() {
+	atomic.StoreInt64(&w.lastActive, time.Now().UnixNano())
+}
+
+func (w *Watchdog) checkIdle() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	if d := w.idle - time.Since(time.Unix(0, atomic.LoadInt64(&w.lastActive))); d > 0 {
+		w.idleTimer.Reset(d)
+		w.mu.Unlock()
+		return
+	}
+	w.mu.Unlock()
+	w.fire("idle timeout")
+}
+
+func (w *Watchdog) fire(reason string) {
+	if w.Stop() {
+		w.expire(reason)
+	}
+}
+
+// Stop 停止计时, 返回 false 表示已经停止过或已经超时
+func (w *Watchdog) Stop() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return false
+	}
+	w.stopped = true
+	if w.idleTimer != nil {
+		w.idleTimer.Stop()
+	}
+	if w.lifeTimer != nil {
+		w.lifeTimer.Stop()
+	}
+	return true
+}
+
+type watchedConn struct {
+	net.Conn
+	watchdog *Watchdog
+}
+
+// WatchConn 返回的连接每次读写到数据时通知 watchdog
+func WatchConn(conn net.Conn, w *Watchdog) net.Conn {
+	return &watchedConn{Conn: conn, watchdog: w}
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.watchdog.Touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.watchdog.Touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
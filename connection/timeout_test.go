@@ -0,0 +1,69 @@
+package connection
+
+import (
+	"testing"
+	"time"
+)
+
+// expired 返回 watchdog 的 expire 和收到的原因
+func expired() (func(reason string), <-chan string) {
+	reasons := make(chan string, 2)
+	return func(reason string) { reasons <- reason }, reasons
+}
+
+func waitReason(t *testing.T, reasons <-chan string, timeout time.Duration) string {
+	t.Helper()
+	select {
+	case reason := <-reasons:
+		return reason
+	case <-time.After(timeout):
+		t.Fatal("watchdog not expired")
+		return ""
+	}
+}
+
+func TestWatchdogIdle(t *testing.T) {
+	expire, reasons := expired()
+	start := time.Now()
+	w := NewWatchdog(100*time.Millisecond, 0, expire)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		w.Touch()
+	}
+	if reason := waitReason(t, reasons, time.Second); reason != "idle timeout" {
+		t.Fatalf("expired: %s", reason)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Fatalf("expired after %s, touch ignored", d)
+	}
+	if w.Stop() {
+		t.Fatal("stopped twice")
+	}
+	select {
+	case reason := <-reasons:
+		t.Fatalf("expired again: %s", reason)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatchdogLifetime(t *testing.T) {
+	expire, reasons := expired()
+	w := NewWatchdog(time.Second, 100*time.Millisecond, expire)
+	defer w.Stop()
+	if reason := waitReason(t, reasons, time.Second); reason != "max session duration exceeded" {
+		t.Fatalf("expired: %s", reason)
+	}
+}
+
+func TestWatchdogStop(t *testing.T) {
+	expire, reasons := expired()
+	w := NewWatchdog(50*time.Millisecond, 50*time.Millisecond, expire)
+	if !w.Stop() {
+		t.Fatal("stop failed")
+	}
+	select {
+	case reason := <-reasons:
+		t.Fatalf("expired after stop: %s", reason)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
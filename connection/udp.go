@@ -0,0 +1,90 @@
+package connection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// MaxUDPPacketSize 是 UDP 包的最大长度
+const MaxUDPPacketSize = 65535
+
+// WriteUDPPacket 在 UDP ASSOCIATE 之后的隧道中写入一个 UDP 包, 只调用一次 Write:
+//
+//	+------+----------+----------+--------+----------+
+//	| ATYP | DST.ADDR | DST.PORT | LENGTH |   DATA   |
+//	+------+----------+----------+--------+----------+
+//	|  1   | Variable |    2     |   2    | Variable |
+//	+------+----------+----------+--------+----------+
+//
+// Client 发送时地址为目标, Server 返回时地址为来源
+func WriteUDPPacket(w io.Writer, addr *Addr, data []byte) error {
+	if len(data) > MaxUDPPacketSize {
+		return fmt.Errorf("udp packet too long: %d", len(data))
+	}
+	b := addr.Bytes()
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+	_, err := w.Write(append(b, data...))
+	return err
+}
+
+// ReadUDPPacket 读取 WriteUDPPacket 写入的包, 数据读入 buf, buf 不够长时返回错误
+func ReadUDPPacket(r io.Reader, buf []byte) (addr *Addr, n int, err error) {
+	if addr, err = ReadAddr(r); err != nil {
+		return nil, 0, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(r, length[:]); err != nil {
+		return nil, 0, err
+	}
+	n = int(binary.BigEndian.Uint16(length[:]))
+	if n > len(buf) {
+		return nil, 0, fmt.Errorf("udp packet too long: %d", n)
+	}
+	if _, err = io.ReadFull(r, buf[:n]); err != nil {
+		return nil, 0, err
+	}
+	return addr, n, nil
+}
+
+// ReadAddr 从流中读取 ATYP | ADDR | PORT
+func ReadAddr(r io.Reader) (*Addr, error) {
+	b := make([]byte, 2, 1+1+255+2)
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return nil, err
+	}
+	var left int
+	switch b[0] {
+	case AtypIPv4:
+		left = net.IPv4len + 2
+	case AtypIPv6:
+		left = net.IPv6len + 2
+	case AtypDomain:
+		if _, err := io.ReadFull(r, b[1:2]); err != nil {
+			return nil, err
+		}
+		left = int(b[1]) + 2
+	default:
+		return nil, fmt.Errorf("no such ATYP: %d", b[0])
+	}
+	head := 1
+	if b[0] == AtypDomain {
+		head = 2
+	}
+	b = b[:head+left]
+	if _, err := io.ReadFull(r, b[head:]); err != nil {
+		return nil, err
+	}
+	addr, _, err := ParseAddr(b)
+	return addr, err
+}
+
+// UDPAddr 把 net.UDPAddr 转换为 Addr
+func UDPAddr(addr *net.UDPAddr) *Addr {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &Addr{IP: ip, Port: addr.Port}
+}
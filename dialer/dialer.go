@@ -0,0 +1,97 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"net"
+	"time"
+)
+
+// Dialer 用于连接目标地址. *net.Dialer 和 golang.org/x/net/proxy.ContextDialer 都满足这个接口,
+// 可以用来绑定源地址/网卡, 设置 SO_MARK, 或者经过其他代理连接
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Func 把普通函数转换为 Dialer
+type Func func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f Func) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// Direct 直接连接目标, 双栈时使用 happy eyeballs
+var Direct Dialer = &net.Dialer{}
+
+// Dial 使用 d 连接 address, d 为 nil 时使用 Direct, timeout 为 0 表示不限制
+func Dial(d Dialer, timeout time.Duration, network, address string) (net.Conn, error) {
+	return DialContext(context.Background(), d, timeout, network, address)
+}
+
+// DialContext 与 Dial 相同, ctx 结束时放弃连接
+func DialContext(ctx context.Context, d Dialer, timeout time.Duration, network, address string) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := orDirect(d).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func orDirect(d Dialer) Dialer {
+	if d == nil {
+		return Direct
+	}
+	return d
+}
+
+func checkNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+}
+
+// Handshake 执行 fn 期间使用 ctx 的截止时间, ctx 被取消时中断 conn 上的读写, 用于在 conn 上完成代理协议的握手
+func Handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err := fn()
+	close(stop)
+	<-exited
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil && Done(ctx) {
+		if ctx.Err() != nil {
+			return errors.Trace(ctx.Err())
+		}
+		return errors.Trace(context.DeadlineExceeded)
+	}
+	return errors.Trace(err)
+}
+
+// Done 检查 ctx 是否已经结束. 连接的截止时间可能比 ctx 的计时器先触发, 截止时间已过也算结束
+func Done(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
@@ -0,0 +1,76 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+type httpDialer struct {
+	addr     string
+	username string
+	password string
+	forward  Dialer
+}
+
+// NewHTTP 经过 addr 上的 HTTP 代理使用 CONNECT 连接目标, username 不为空时使用 Basic 认证.
+// forward 用于连接代理本身, 为 nil 时直接连接
+func NewHTTP(addr, username, password string, forward Dialer) Dialer {
+	return &httpDialer{addr: addr, username: username, password: password, forward: forward}
+}
+
+func (d *httpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := orDirect(d.forward).DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result net.Conn
+	err = Handshake(ctx, conn, func() (err error) {
+		result, err = d.connect(conn, address)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Annotatef(err, "http proxy %s", d.addr)
+	}
+	return result, nil
+}
+
+func (d *httpDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.username != "" {
+		token := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, errors.Trace(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connect %s: %s", address, resp.Status)
+	}
+	if br.Buffered() == 0 {
+		return conn, nil
+	}
+	// 代理在响应后立即发送了目标的数据
+	return connection.NewBufferedConn(conn, br), nil
+}
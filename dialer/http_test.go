@@ -0,0 +1,95 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/obgnail/shadowsocks-toy/connection"
+)
+
+// startHTTP 启动一个只支持 CONNECT 的 HTTP 代理, username 不为空时要求 Basic 认证
+func startHTTP(t *testing.T, username, password string) *fakeProxy {
+	t.Helper()
+	p := &fakeProxy{}
+	p.addr = startListener(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect {
+			conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+			return
+		}
+		if username != "" {
+			token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+			if req.Header.Get("Proxy-Authorization") != "Basic "+token {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				return
+			}
+		}
+		target, err := p.connect(req.Host)
+		if err != nil {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		defer target.Close()
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			return
+		}
+		connection.Copy(connection.NewBufferedConn(conn, br), target)
+	})
+	return p
+}
+
+func TestHTTP(t *testing.T) {
+	target := startEcho(t)
+	p := startHTTP(t, "", "")
+	checkEcho(t, NewHTTP(p.addr, "", "", nil), target)
+	if got := p.targets(); len(got) != 1 || got[0] != target {
+		t.Fatalf("proxy dialed %v, want %s", got, target)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	target := startEcho(t)
+	p := startHTTP(t, "user", "pass")
+	checkEcho(t, NewHTTP(p.addr, "user", "pass", nil), target)
+
+	for _, tc := range []struct{ username, password string }{
+		{"", ""},
+		{"user", "wrong"},
+	} {
+		d := NewHTTP(p.addr, tc.username, tc.password, nil)
+		if conn, err := d.DialContext(context.Background(), "tcp", target); err == nil {
+			conn.Close()
+			t.Fatalf("%q/%q: dial succeeded", tc.username, tc.password)
+		}
+	}
+	if got := p.targets(); len(got) != 1 {
+		t.Fatalf("proxy dialed %v without auth", got)
+	}
+}
+
+// 代理在 200 之后紧接着发送目标的数据
+func TestHTTPBufferedData(t *testing.T) {
+	addr := startListener(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\nbanner"))
+	})
+	conn, err := NewHTTP(addr, "", "", nil).DialContext(context.Background(), "tcp", "example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 6)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "banner" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
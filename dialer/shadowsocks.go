@@ -0,0 +1,47 @@
+package dialer
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"net"
+)
+
+type shadowsocksDialer struct {
+	addr    string
+	cipher  cipher.Cipher
+	forward Dialer
+}
+
+// NewShadowsocks 经过 addr 上的 Server 连接目标, 用于多跳的代理链. 不使用连接池和多路复用, 需要时使用 upstream.
+// forward 用于连接 Server 本身, 为 nil 时直接连接
+func NewShadowsocks(addr string, c cipher.Cipher, forward Dialer) Dialer {
+	if c == nil {
+		c = cipher.NewNopCipher()
+	}
+	return &shadowsocksDialer{addr: addr, cipher: c, forward: forward}
+}
+
+func (d *shadowsocksDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, errors.Trace(err)
+	}
+	dst, err := connection.NewAddr(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := orDirect(d.forward).DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	serverConn := connection.NewSecureSocket(conn, d.cipher)
+	err = Handshake(ctx, conn, func() error {
+		return connection.SendSocks5Data(serverConn, []byte{0x05, 0x01, connection.MethodNoAuth}, connection.NewRequest(dst))
+	})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Annotatef(err, "shadowsocks server %s", d.addr)
+	}
+	return connection.NewPlainConn(serverConn), nil
+}
@@ -0,0 +1,119 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"io"
+	"net"
+)
+
+type socks5Dialer struct {
+	addr     string
+	username string
+	password string
+	forward  Dialer
+}
+
+// NewSocks5 经过 addr 上的 socks5 代理连接目标, username 不为空时使用用户名/密码认证(RFC 1929).
+// forward 用于连接代理本身, 为 nil 时直接连接
+func NewSocks5(addr, username, password string, forward Dialer) Dialer {
+	return &socks5Dialer{addr: addr, username: username, password: password, forward: forward}
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, errors.Trace(err)
+	}
+	dst, err := connection.NewAddr(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := orDirect(d.forward).DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := Handshake(ctx, conn, func() error { return d.connect(conn, dst) }); err != nil {
+		conn.Close()
+		return nil, errors.Annotatef(err, "socks5 proxy %s", d.addr)
+	}
+	return conn, nil
+}
+
+func (d *socks5Dialer) connect(conn net.Conn, dst *connection.Addr) error {
+	methods := []byte{connection.MethodNoAuth}
+	if d.username != "" {
+		methods = append(methods, connection.MethodUserPass)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return errors.Trace(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return errors.Trace(err)
+	}
+	if buf[0] != 0x05 {
+		return fmt.Errorf("error socks version: %d", buf[0])
+	}
+	switch buf[1] {
+	case connection.MethodNoAuth:
+	case connection.MethodUserPass:
+		if err := d.auth(conn); err != nil {
+			return errors.Trace(err)
+		}
+	case connection.MethodNoAcceptable:
+		return fmt.Errorf("no acceptable auth method")
+	default:
+		return fmt.Errorf("unsupported auth method: %d", buf[1])
+	}
+
+	if _, err := conn.Write(connection.NewRequest(dst)); err != nil {
+		return errors.Trace(err)
+	}
+	// VER | REP | RSV | ATYP | BND.ADDR | BND.PORT
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.Trace(err)
+	}
+	if reply[1] != connection.RepSucceeded {
+		return fmt.Errorf("socks5 request failed: %d", reply[1])
+	}
+	var left int
+	switch reply[3] {
+	case connection.AtypIPv4:
+		left = net.IPv4len - 1 + 2
+	case connection.AtypIPv6:
+		left = net.IPv6len - 1 + 2
+	case connection.AtypDomain:
+		left = int(reply[4]) + 2
+	default:
+		return fmt.Errorf("no such ATYP: %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, left)); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// auth 用户名/密码认证: VER(0x01) | ULEN | UNAME | PLEN | PASSWD
+func (d *socks5Dialer) auth(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return fmt.Errorf("username or password too long")
+	}
+	req := []byte{0x01, byte(len(d.username))}
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := conn.Write(req); err != nil {
+		return errors.Trace(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return errors.Trace(err)
+	}
+	if buf[1] != connection.UserPassSucceeded {
+		return fmt.Errorf("socks5 auth failed: %d", buf[1])
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package dialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+)
+
+// startEcho 启动一个回显目标
+func startEcho(t *testing.T) string {
+	t.Helper()
+	return startListener(t, func(conn net.Conn) { io.Copy(conn, conn) })
+}
+
+// startListener 在本地端口上用 handle 处理每个连接, 返回监听的地址
+func startListener(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// fakeProxy 记录代理连接过的目标
+type fakeProxy struct {
+	addr string
+
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (p *fakeProxy) connect(address string) (net.Conn, error) {
+	p.mu.Lock()
+	p.dialed = append(p.dialed, address)
+	p.mu.Unlock()
+	return net.Dial("tcp", address)
+}
+
+func (p *fakeProxy) targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.dialed...)
+}
+
+// startSocks5 启动一个 socks5 代理, username 不为空时要求用户名/密码认证.
+// 不加密, 也可以作为 cipher 为 nop 的 ss Server
+func startSocks5(t *testing.T, username, password string) *fakeProxy {
+	t.Helper()
+	p := &fakeProxy{}
+	p.addr = startListener(t, func(conn net.Conn) {
+		sc := connection.NewSecureSocket(conn, cipher.NewNopCipher())
+		_, methods, err := connection.ReadHandshake(sc)
+		if err != nil {
+			return
+		}
+		want := byte(connection.MethodNoAuth)
+		if username != "" {
+			want = connection.MethodUserPass
+		}
+		if !contains(methods, want) {
+			connection.ReplyHandshake(sc, connection.MethodNoAcceptable)
+			return
+		}
+		if err := connection.ReplyHandshake(sc, want); err != nil {
+			return
+		}
+		if username != "" {
+			u, pw, err := connection.ReadUserPass(sc)
+			if err != nil {
+				return
+			}
+			if u != username || pw != password {
+				connection.ReplyUserPass(sc, connection.UserPassFailed)
+				return
+			}
+			if err := connection.ReplyUserPass(sc, connection.UserPassSucceeded); err != nil {
+				return
+			}
+		}
+		_, dst, err := connection.ReadRequest(sc)
+		if err != nil {
+			return
+		}
+		target, err := p.connect(dst.String())
+		if err != nil {
+			connection.ReplyRequest(sc, connection.RepHostUnreachable)
+			return
+		}
+		defer target.Close()
+		if err := connection.ReplyRequest(sc, connection.RepSucceeded); err != nil {
+			return
+		}
+		connection.Copy(conn, target)
+	})
+	return p
+}
+
+func contains(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEcho 通过 d 连接回显目标 address, 检查回显
+func checkEcho(t *testing.T, d Dialer, address string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("echo %q", buf)
+	}
+}
+
+func TestSocks5(t *testing.T) {
+	target := startEcho(t)
+	p := startSocks5(t, "", "")
+	checkEcho(t, NewSocks5(p.addr, "", "", nil), target)
+	if got := p.targets(); len(got) != 1 || got[0] != target {
+		t.Fatalf("proxy dialed %v, want %s", got, target)
+	}
+
+	// 代理连接不上目标
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	if conn, err := NewSocks5(p.addr, "", "", nil).DialContext(context.Background(), "tcp", closed); err == nil {
+		conn.Close()
+		t.Fatal("dialed an unreachable target")
+	}
+}
+
+func TestSocks5Auth(t *testing.T) {
+	target := startEcho(t)
+	p := startSocks5(t, "user", "pass")
+	checkEcho(t, NewSocks5(p.addr, "user", "pass", nil), target)
+
+	for _, tc := range []struct{ username, password string }{
+		{"", ""},
+		{"user", "wrong"},
+	} {
+		d := NewSocks5(p.addr, tc.username, tc.password, nil)
+		if conn, err := d.DialContext(context.Background(), "tcp", target); err == nil {
+			conn.Close()
+			t.Fatalf("%q/%q: dial succeeded", tc.username, tc.password)
+		}
+	}
+	if got := p.targets(); len(got) != 1 {
+		t.Fatalf("proxy dialed %v without auth", got)
+	}
+}
+
+func TestSocks5Network(t *testing.T) {
+	d := NewSocks5("127.0.0.1:1", "", "", nil)
+	if _, err := d.DialContext(context.Background(), "udp", "127.0.0.1:53"); err == nil {
+		t.Fatal("dialed udp")
+	}
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"net"
+	"strings"
+)
+
+type resolveDialer struct {
+	resolver Resolver
+	forward  dialer.Dialer
+}
+
+// NewDialer 先用 r 解析域名, 再用 forward 依次连接解析出的 IP, forward 为 nil 时直接连接.
+// forward 是代理时, 域名不会再交给代理解析
+func NewDialer(r Resolver, forward dialer.Dialer) dialer.Dialer {
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	return &resolveDialer{resolver: r, forward: forward}
+}
+
+func (d *resolveDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !matchNetwork(network, ip) {
+			return nil, fmt.Errorf("no %s address for %s", network, host)
+		}
+		return d.forward.DialContext(ctx, network, address)
+	}
+	ips, err := d.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	err = fmt.Errorf("no %s address for %s", network, host)
+	for _, ip := range ips {
+		if !matchNetwork(network, ip) {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = d.forward.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Trace(err)
+}
+
+// ResolveNetwork 在 network 限制了地址族时(tcp4/tcp6, udp4/udp6)用 r 把 address 中的域名解析为该地址族的 IP,
+// r 为 nil 时使用 System. 用于把域名交给代理之前确定地址族, 其他 network 原样返回 address
+func ResolveNetwork(ctx context.Context, r Resolver, network, address string) (string, error) {
+	if !strings.HasSuffix(network, "4") && !strings.HasSuffix(network, "6") {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if r == nil {
+			r = System
+		}
+		if ips, err = r.LookupIP(ctx, host); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	for _, ip := range ips {
+		if matchNetwork(network, ip) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return "", fmt.Errorf("no %s address for %s", network, host)
+}
+
+// matchNetwork 检查 ip 是否符合 network 的地址族
+func matchNetwork(network string, ip net.IP) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(network, "6"):
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/obgnail/shadowsocks-toy/dialer"
+)
+
+// staticResolver 把所有域名解析为固定的 IP
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestResolveNetwork(t *testing.T) {
+	r := staticResolver{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}
+	for _, tc := range []struct {
+		network, address, want string
+	}{
+		{"tcp", "both.test:80", "both.test:80"},
+		{"tcp4", "both.test:80", "127.0.0.1:80"},
+		{"tcp6", "both.test:80", "[::1]:80"},
+		{"udp4", "both.test:53", "127.0.0.1:53"},
+		{"tcp4", "10.0.0.1:80", "10.0.0.1:80"},
+		{"tcp6", "10.0.0.1:80", ""},
+		{"tcp4", "[::1]:80", ""},
+	} {
+		got, err := ResolveNetwork(context.Background(), r, tc.network, tc.address)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("ResolveNetwork(%s, %s) = %s, want error", tc.network, tc.address, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ResolveNetwork(%s, %s) = %s %v, want %s", tc.network, tc.address, got, err, tc.want)
+		}
+	}
+}
+
+func TestDialerNetwork(t *testing.T) {
+	var dialed []string
+	forward := dialer.Func(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	})
+	d := NewDialer(staticResolver{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, forward)
+	conn, err := d.DialContext(context.Background(), "tcp4", "both.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := d.DialContext(context.Background(), "tcp4", "[::1]:80"); err == nil {
+		t.Fatal("dialed an IPv6 address with tcp4")
+	}
+	if len(dialed) != 1 || dialed[0] != "tcp4 127.0.0.1:80" {
+		t.Fatalf("dialed %v", dialed)
+	}
+}
@@ -0,0 +1,246 @@
+package dns
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultFakeIPRange 是保留给基准测试的地址段, 不会出现在公网上
+	DefaultFakeIPRange = "198.18.0.0/15"
+	fakeIPTTL          = 1
+)
+
+type fakeIPEntry struct {
+	host string
+	ip   uint32
+}
+
+// FakeIP 从地址池中为域名分配假 IP, 连接假 IP 时可以找回域名.
+// 地址池满时淘汰最久没有使用的映射
+type FakeIP struct {
+	network *net.IPNet
+	first   uint32 // 第一个可用地址
+	size    uint32 // 可用地址数量
+
+	mu     sync.Mutex
+	lru    *list.List // front 为最近使用
+	byHost map[string]*list.Element
+	byIP   map[uint32]*list.Element
+	next   uint32 // 下一个尝试分配的偏移
+	dirty  bool   // 上次 Save 之后是否有新的映射
+}
+
+// NewFakeIP 使用 cidr 中的 IPv4 地址, 不包括网络地址和广播地址. size 为 0 或超过可用地址数量时使用全部地址
+func NewFakeIP(cidr string, size int) (*FakeIP, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("fake ip range must be ipv4: %s", cidr)
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("fake ip range too small: %s", cidr)
+	}
+	total := uint32(1)<<uint(bits-ones) - 2
+	if size > 0 && uint32(size) < total {
+		total = uint32(size)
+	}
+	return &FakeIP{
+		network: network,
+		first:   ipToUint(network.IP) + 1,
+		size:    total,
+		lru:     list.New(),
+		byHost:  make(map[string]*list.Element),
+		byIP:    make(map[uint32]*list.Element),
+	}, nil
+}
+
+// Contains 判断 ip 是否在地址池中
+func (f *FakeIP) Contains(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	n := ipToUint(ip4)
+	return n >= f.first && n < f.first+f.size
+}
+
+// Lookup 返回 host 的假 IP, 没有时分配一个
+func (f *FakeIP) Lookup(host string) net.IP {
+	host = canonicalName(host)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if elem, ok := f.byHost[host]; ok {
+		f.lru.MoveToFront(elem)
+		return uintToIP(elem.Value.(*fakeIPEntry).ip)
+	}
+
+	var ip uint32
+	if uint32(f.lru.Len()) >= f.size {
+		oldest := f.lru.Back()
+		entry := f.lru.Remove(oldest).(*fakeIPEntry)
+		delete(f.byHost, entry.host)
+		delete(f.byIP, entry.ip)
+		ip = entry.ip
+	} else {
+		for {
+			ip = f.first + f.next
+			f.next = (f.next + 1) % f.size
+			if _, used := f.byIP[ip]; !used {
+				break
+			}
+		}
+	}
+	f.add(host, ip)
+	return uintToIP(ip)
+}
+
+// Host 返回假 IP 对应的域名
+func (f *FakeIP) Host(ip net.IP) (string, bool) {
+	if !f.Contains(ip) {
+		return "", false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	elem, ok := f.byIP[ipToUint(ip.To4())]
+	if !ok {
+		return "", false
+	}
+	f.lru.MoveToFront(elem)
+	return elem.Value.(*fakeIPEntry).host, true
+}
+
+// Len 返回当前的映射数量
+func (f *FakeIP) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lru.Len()
+}
+
+// Dirty 返回上次 Save 之后是否分配过新的映射
+func (f *FakeIP) Dirty() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dirty
+}
+
+// add 调用时需要持有锁
+func (f *FakeIP) add(host string, ip uint32) {
+	elem := f.lru.PushFront(&fakeIPEntry{host: host, ip: ip})
+	f.byHost[host] = elem
+	f.byIP[ip] = elem
+	f.dirty = true
+}
+
+// ServeDNS 用假 IP 响应 A 请求, AAAA 和其他请求返回空结果, 让应用使用 IPv4
+func (f *FakeIP) ServeDNS(_ context.Context, query []byte) ([]byte, error) {
+	m, err := Unpack(query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(m.Questions) == 0 {
+		return ErrorReply(query, RcodeFormatError), nil
+	}
+	q := m.Questions[0]
+	var answers []Record
+	if q.Type == TypeA && q.Class == ClassINET {
+		answers = append(answers, NewIPRecord(q.Name, f.Lookup(q.Name), fakeIPTTL))
+	}
+	resp, err := m.Reply(RcodeSuccess, answers...).Pack()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp, nil
+}
+
+// Save 把映射按最久未使用到最近使用的顺序写入 path, 每行为 "ip host"
+func (f *FakeIP) Save(path string) error {
+	f.mu.Lock()
+	var b strings.Builder
+	for elem := f.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*fakeIPEntry)
+		fmt.Fprintf(&b, "%s %s\n", uintToIP(entry.ip), entry.host)
+	}
+	f.dirty = false
+	f.mu.Unlock()
+
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(b.String()), 0644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		f.mu.Lock()
+		f.dirty = true
+		f.mu.Unlock()
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Load 读取 Save 写入的映射, 不在地址池中的记录会被忽略, 文件不存在时不报错
+func (f *FakeIP) Load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// 恢复的映射已经在文件中
+	dirty := f.dirty
+	defer func() { f.dirty = dirty }()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || !f.Contains(ip) {
+			continue
+		}
+		n, host := ipToUint(ip.To4()), canonicalName(fields[1])
+		if _, ok := f.byIP[n]; ok {
+			continue
+		}
+		if old, ok := f.byHost[host]; ok {
+			f.lru.Remove(old)
+			delete(f.byIP, old.Value.(*fakeIPEntry).ip)
+		}
+		if uint32(f.lru.Len()) >= f.size {
+			oldest := f.lru.Remove(f.lru.Back()).(*fakeIPEntry)
+			delete(f.byHost, oldest.host)
+			delete(f.byIP, oldest.ip)
+		}
+		f.add(host, n)
+		// 从最后一条记录之后继续分配, 到达地址池末尾时回到开头
+		f.next = (n - f.first + 1) % f.size
+	}
+	return errors.Trace(scanner.Err())
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
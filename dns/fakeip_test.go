@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFakeIPLookup(t *testing.T) {
+	f, err := NewFakeIP("10.0.0.0/29", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := f.Lookup("A.test.")
+	if !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("first fake ip %s", ip)
+	}
+	if again := f.Lookup("a.test"); !again.Equal(ip) {
+		t.Fatalf("lookup again %s, want %s", again, ip)
+	}
+	if host, ok := f.Host(ip); !ok || host != "a.test" {
+		t.Fatalf("host %q %v", host, ok)
+	}
+	if _, ok := f.Host(net.ParseIP("10.0.0.7")); ok {
+		t.Fatal("broadcast address in pool")
+	}
+}
+
+func TestFakeIPLoadWraps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fakeip")
+	// 最后一条记录是地址池中的最后一个地址
+	data := "10.0.0.3 c.test\n10.0.0.6 f.test\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFakeIP("10.0.0.0/29", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if f.Dirty() {
+		t.Fatal("dirty after load")
+	}
+	if ip := f.Lookup("new.test"); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("allocated %s after load, want 10.0.0.1", ip)
+	}
+	if host, ok := f.Host(net.ParseIP("10.0.0.6")); !ok || host != "f.test" {
+		t.Fatalf("restored host %q %v", host, ok)
+	}
+}
+
+func TestFakeIPSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fakeip")
+	f, err := NewFakeIP("10.0.0.0/29", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Lookup("a.test")
+	f.Lookup("b.test")
+	if !f.Dirty() {
+		t.Fatal("not dirty after lookup")
+	}
+	if err := f.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if f.Dirty() {
+		t.Fatal("dirty after save")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "10.0.0.1 a.test\n10.0.0.2 b.test\n" {
+		t.Fatalf("saved %q", b)
+	}
+}
@@ -0,0 +1,48 @@
+package dns
+
+import (
+	"bufio"
+	"github.com/juju/errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// ParseHosts 解析 /etc/hosts 格式的静态 hosts
+func ParseHosts(r io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return hosts, nil
+}
+
+// LoadHosts 读取 hosts 文件
+func LoadHosts(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	return ParseHosts(f)
+}
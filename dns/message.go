@@ -0,0 +1,292 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypePTR   uint16 = 12
+	TypeAAAA  uint16 = 28
+
+	ClassINET uint16 = 1
+)
+
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3 // NXDOMAIN
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+const headerLen = 12
+
+var errShortMessage = fmt.Errorf("short dns message")
+
+type Question struct {
+	Name  string // 全小写, 不带结尾的 "."
+	Type  uint16
+	Class uint16
+}
+
+// Record 是一条资源记录. Data 是 rdata, 其中的域名(CNAME/NS/PTR)已经解压缩
+type Record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// IP 返回 A/AAAA 记录的地址, 其他记录返回 nil
+func (r *Record) IP() net.IP {
+	if (r.Type == TypeA && len(r.Data) == net.IPv4len) || (r.Type == TypeAAAA && len(r.Data) == net.IPv6len) {
+		return net.IP(r.Data)
+	}
+	return nil
+}
+
+// NewIPRecord 构造 A/AAAA 记录
+func NewIPRecord(name string, ip net.IP, ttl uint32) Record {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Record{Name: name, Type: TypeA, Class: ClassINET, TTL: ttl, Data: []byte(ip4)}
+	}
+	return Record{Name: name, Type: TypeAAAA, Class: ClassINET, TTL: ttl, Data: []byte(ip.To16())}
+}
+
+// Message 是简化的 dns 报文, 只处理 question 和 answer 段, 解析时忽略 authority 和 additional 段
+type Message struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              uint8
+
+	Questions []Question
+	Answers   []Record
+}
+
+// NewQuery 构造查询 name 的 type 记录的请求
+func NewQuery(id uint16, name string, typ uint16) *Message {
+	return &Message{
+		ID:               id,
+		RecursionDesired: true,
+		Questions:        []Question{{Name: canonicalName(name), Type: typ, Class: ClassINET}},
+	}
+}
+
+// Reply 构造 m 的响应, question 与 m 相同
+func (m *Message) Reply(rcode uint8, answers ...Record) *Message {
+	return &Message{
+		ID:                 m.ID,
+		Response:           true,
+		Opcode:             m.Opcode,
+		RecursionDesired:   m.RecursionDesired,
+		RecursionAvailable: true,
+		Rcode:              rcode,
+		Questions:          m.Questions,
+		Answers:            answers,
+	}
+}
+
+// header:
+//
+//	+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//	|                      ID                       |
+//	+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//	|QR|   Opcode  |AA|TC|RD|RA|   Z    |   RCODE   |
+//	+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//	|    QDCOUNT | ANCOUNT | NSCOUNT | ARCOUNT      |
+//	+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+
+// Pack 编码报文, 域名不压缩
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	var flags uint16
+	if m.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(m.Opcode&0x0f) << 11
+	if m.Authoritative {
+		flags |= 1 << 10
+	}
+	if m.Truncated {
+		flags |= 1 << 9
+	}
+	if m.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if m.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	flags |= uint16(m.Rcode & 0x0f)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, r := range m.Answers {
+		if b, err = appendName(b, r.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, r.Type)
+		b = binary.BigEndian.AppendUint16(b, r.Class)
+		b = binary.BigEndian.AppendUint32(b, r.TTL)
+		if len(r.Data) > 0xffff {
+			return nil, fmt.Errorf("rdata too long: %d", len(r.Data))
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+		b = append(b, r.Data...)
+	}
+	return b, nil
+}
+
+// Unpack 解析报文
+func Unpack(b []byte) (*Message, error) {
+	if len(b) < headerLen {
+		return nil, errShortMessage
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	m := &Message{
+		ID:                 binary.BigEndian.Uint16(b[0:]),
+		Response:           flags&(1<<15) != 0,
+		Opcode:             uint8(flags>>11) & 0x0f,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		Rcode:              uint8(flags & 0x0f),
+	}
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	anCount := int(binary.BigEndian.Uint16(b[6:]))
+
+	off := headerLen
+	for i := 0; i < qdCount; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+4 > len(b) {
+			return nil, errShortMessage
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[off:]),
+			Class: binary.BigEndian.Uint16(b[off+2:]),
+		})
+		off += 4
+	}
+	for i := 0; i < anCount; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+10 > len(b) {
+			return nil, errShortMessage
+		}
+		r := Record{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[off:]),
+			Class: binary.BigEndian.Uint16(b[off+2:]),
+			TTL:   binary.BigEndian.Uint32(b[off+4:]),
+		}
+		length := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+length > len(b) {
+			return nil, errShortMessage
+		}
+		switch r.Type {
+		case TypeCNAME, TypeNS, TypePTR:
+			target, _, err := readName(b, off)
+			if err != nil {
+				return nil, err
+			}
+			if r.Data, err = appendName(nil, target); err != nil {
+				return nil, err
+			}
+		default:
+			r.Data = append([]byte(nil), b[off:off+length]...)
+		}
+		off += length
+		m.Answers = append(m.Answers, r)
+	}
+	return m, nil
+}
+
+// readName 从 off 开始读取可能被压缩的域名, 返回域名和域名之后的偏移
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			off++
+			if next == -1 {
+				next = off
+			}
+			return strings.ToLower(strings.Join(labels, ".")), next, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(b) {
+				return "", 0, errShortMessage
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, fmt.Errorf("too many compression pointers")
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case l&0xc0 != 0:
+			return "", 0, fmt.Errorf("unsupported label type: %x", l)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func appendName(b []byte, name string) ([]byte, error) {
+	name = canonicalName(name)
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name: %s", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// canonicalName 转为小写并去掉结尾的 "."
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,336 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout   = 5 * time.Second
+	defaultCacheSize = 1024
+	defaultMinTTL    = 10 * time.Second
+	defaultMaxTTL    = time.Hour
+	// NXDOMAIN 或没有记录时的缓存时间
+	negativeTTL = 30 * time.Second
+)
+
+// Resolver 把域名解析为 IP
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// System 使用系统的解析器
+var System Resolver = systemResolver{}
+
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ips, nil
+}
+
+type Prefer int
+
+const (
+	PreferIPv4 Prefer = iota // 同时查询 A 和 AAAA, IPv4 在前
+	PreferIPv6               // 同时查询 A 和 AAAA, IPv6 在前
+	IPv4Only
+	IPv6Only
+)
+
+// Client 是带缓存的 Resolver: 先查静态 hosts, 再查缓存, 最后依次尝试上游
+type Client struct {
+	upstreams []Upstream
+
+	Hosts     map[string][]net.IP // 静态 hosts, key 为小写域名
+	Prefer    Prefer
+	Timeout   time.Duration // 每个上游的超时时间
+	CacheSize int           // 0 表示不缓存
+	MinTTL    time.Duration // 缓存时间不短于 MinTTL, 不长于 MaxTTL
+	MaxTTL    time.Duration
+
+	mu    sync.Mutex
+	cache map[cacheKey]*list.Element
+	lru   *list.List // front 为最近使用
+}
+
+type cacheKey struct {
+	name string
+	typ  uint16
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	ips    []net.IP
+	expire time.Time
+}
+
+func NewClient(upstreams ...Upstream) *Client {
+	return &Client{
+		upstreams: upstreams,
+		Timeout:   defaultTimeout,
+		CacheSize: defaultCacheSize,
+		MinTTL:    defaultMinTTL,
+		MaxTTL:    defaultMaxTTL,
+	}
+}
+
+// ParseClient 由上游地址构造 Client, 地址格式见 NewUpstream
+func ParseClient(addrs ...string) (*Client, error) {
+	upstreams := make([]Upstream, 0, len(addrs))
+	for _, addr := range addrs {
+		u, err := NewUpstream(addr, nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	return NewClient(upstreams...), nil
+}
+
+func (c *Client) Upstreams() []Upstream { return c.upstreams }
+
+func (c *Client) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	name := canonicalName(host)
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if ips, ok := c.Hosts[name]; ok {
+		if ips = c.filter(ips); len(ips) > 0 {
+			return ips, nil
+		}
+	}
+
+	var types []uint16
+	switch c.Prefer {
+	case IPv4Only:
+		types = []uint16{TypeA}
+	case IPv6Only:
+		types = []uint16{TypeAAAA}
+	case PreferIPv6:
+		types = []uint16{TypeAAAA, TypeA}
+	default:
+		types = []uint16{TypeA, TypeAAAA}
+	}
+	results := make([][]net.IP, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i, typ := range types {
+		wg.Add(1)
+		go func(i int, typ uint16) {
+			defer wg.Done()
+			results[i], errs[i] = c.lookup(ctx, name, typ)
+		}(i, typ)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	for _, r := range results {
+		ips = append(ips, r...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return nil, fmt.Errorf("no such host: %s", name)
+}
+
+// PurgeCache 清空缓存
+func (c *Client) PurgeCache() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache = nil
+	c.lru = nil
+}
+
+func (c *Client) filter(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch c.Prefer {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv6:
+		return append(v6, v4...)
+	default:
+		return append(v4, v6...)
+	}
+}
+
+func (c *Client) lookup(ctx context.Context, name string, typ uint16) ([]net.IP, error) {
+	key := cacheKey{name: name, typ: typ}
+	if ips, ok := c.getCache(key); ok {
+		return ips, nil
+	}
+	query := NewQuery(queryID(), name, typ)
+	resp, err := c.Exchange(ctx, query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch resp.Rcode {
+	case RcodeSuccess:
+	case RcodeNameError:
+		c.setCache(key, nil, negativeTTL)
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("lookup %s: rcode %d", name, resp.Rcode)
+	}
+
+	var ips []net.IP
+	ttl := negativeTTL
+	for i, r := range resp.Answers {
+		if i == 0 || time.Duration(r.TTL)*time.Second < ttl {
+			ttl = time.Duration(r.TTL) * time.Second
+		}
+		if r.Type == typ {
+			if ip := r.IP(); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ttl = negativeTTL
+	}
+	c.setCache(key, ips, ttl)
+	return ips, nil
+}
+
+// Exchange 依次尝试上游, 返回第一个成功的响应
+func (c *Client) Exchange(ctx context.Context, query *Message) (*Message, error) {
+	b, err := query.Pack()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if b, err = c.ServeDNS(ctx, b); err != nil {
+		return nil, errors.Trace(err)
+	}
+	resp, err := Unpack(b)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp, nil
+}
+
+// ServeDNS 把编码后的请求原样转发给上游, 依次尝试, 返回第一个成功的响应
+func (c *Client) ServeDNS(ctx context.Context, query []byte) ([]byte, error) {
+	if len(c.upstreams) == 0 {
+		return nil, fmt.Errorf("no dns upstream")
+	}
+	var err error
+	for _, u := range c.upstreams {
+		var resp []byte
+		if resp, err = c.exchange(ctx, u, query); err == nil {
+			return resp, nil
+		}
+		log.Debugf("dns upstream %s err: %s", u, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Annotatef(err, "all dns upstreams failed")
+}
+
+func (c *Client) exchange(ctx context.Context, u Upstream, query []byte) ([]byte, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	resp, err := u.Exchange(ctx, query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(resp) < headerLen || len(query) < 2 || resp[0] != query[0] || resp[1] != query[1] {
+		return nil, fmt.Errorf("mismatched dns response")
+	}
+	return resp, nil
+}
+
+// queryID 返回不可预测的查询 ID, 增加伪造响应的难度
+func queryID() uint16 {
+	var b [2]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func (c *Client) getCache(key cacheKey) ([]net.IP, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.cache[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		c.removeCache(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.ips, true
+}
+
+// setCache 缓存满时先淘汰过期的记录, 仍然满时淘汰最久未使用的
+func (c *Client) setCache(key cacheKey, ips []net.IP, ttl time.Duration) {
+	if c.CacheSize <= 0 {
+		return
+	}
+	if c.MinTTL > 0 && ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[cacheKey]*list.Element)
+		c.lru = list.New()
+	}
+	if elem, ok := c.cache[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.ips, entry.expire = ips, now.Add(ttl)
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.CacheSize {
+		for elem := c.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			if now.After(elem.Value.(*cacheEntry).expire) {
+				c.removeCache(elem)
+			}
+			elem = prev
+		}
+		for c.lru.Len() >= c.CacheSize {
+			c.removeCache(c.lru.Back())
+		}
+	}
+	c.cache[key] = c.lru.PushFront(&cacheEntry{key: key, ips: ips, expire: now.Add(ttl)})
+}
+
+func (c *Client) removeCache(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.cache, elem.Value.(*cacheEntry).key)
+}
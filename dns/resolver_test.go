@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer 是进程内的 dns 服务器, 按 records 响应, 记录收到的请求
+type testServer struct {
+	records map[string][]net.IP
+	// truncate 为 true 时 UDP 响应只设置 TC 标志, 需要改用 TCP 查询
+	truncate bool
+
+	mu      sync.Mutex
+	queries []*Message
+	tcp     int
+}
+
+func (s *testServer) handler(tcp bool) Handler {
+	return HandlerFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		m, err := Unpack(query)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.queries = append(s.queries, m)
+		if tcp {
+			s.tcp++
+		}
+		s.mu.Unlock()
+
+		q := m.Questions[0]
+		ips, ok := s.records[q.Name]
+		if !ok {
+			return m.Reply(RcodeNameError).Pack()
+		}
+		if s.truncate && !tcp {
+			resp := m.Reply(RcodeSuccess)
+			resp.Truncated = true
+			return resp.Pack()
+		}
+		var answers []Record
+		for _, ip := range ips {
+			if r := NewIPRecord(q.Name, ip, 60); r.Type == q.Type {
+				answers = append(answers, r)
+			}
+		}
+		return m.Reply(RcodeSuccess, answers...).Pack()
+	})
+}
+
+func (s *testServer) counts() (queries, tcp int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queries), s.tcp
+}
+
+// start 在同一个端口上监听 UDP 和 TCP, 返回地址
+func (s *testServer) start(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	udp, tcp := NewServer(s.handler(false)), NewServer(s.handler(true))
+	go udp.Serve(conn, nil)
+	go tcp.Serve(nil, listener)
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+func newTestServer() *testServer {
+	return &testServer{records: map[string][]net.IP{
+		"a.test": {net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+	}}
+}
+
+func TestClientLookup(t *testing.T) {
+	for _, scheme := range []string{"udp", "tcp"} {
+		t.Run(scheme, func(t *testing.T) {
+			s := newTestServer()
+			c, err := ParseClient(scheme + "://" + s.start(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips, err := c.LookupIP(context.Background(), "A.test.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.1")) || !ips[1].Equal(net.ParseIP("fd00::1")) {
+				t.Fatalf("ips %v", ips)
+			}
+			// 第二次查询命中缓存
+			if _, err := c.LookupIP(context.Background(), "a.test"); err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := s.counts(); n != 2 {
+				t.Fatalf("%d queries, want 2", n)
+			}
+
+			c.Prefer = IPv6Only
+			if ips, err = c.LookupIP(context.Background(), "a.test"); err != nil || len(ips) != 1 || ips[0].To4() != nil {
+				t.Fatalf("v6only %v %v", ips, err)
+			}
+
+			// NXDOMAIN 也被缓存
+			for i := 0; i < 2; i++ {
+				if ips, err := c.LookupIP(context.Background(), "nope.test"); err == nil {
+					t.Fatalf("nope.test resolved to %v", ips)
+				}
+			}
+			if n, _ := s.counts(); n != 3 {
+				t.Fatalf("%d queries, want 3", n)
+			}
+		})
+	}
+}
+
+func TestClientTruncated(t *testing.T) {
+	s := newTestServer()
+	s.truncate = true
+	c, err := ParseClient(s.start(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Prefer = IPv4Only
+	ips, err := c.LookupIP(context.Background(), "a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("ips %v", ips)
+	}
+	if _, tcp := s.counts(); tcp != 1 {
+		t.Fatalf("%d tcp queries, want 1", tcp)
+	}
+}
+
+func TestClientQueryID(t *testing.T) {
+	s := newTestServer()
+	c, err := ParseClient(s.start(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CacheSize = 0
+	c.Prefer = IPv4Only
+	for i := 0; i < 8; i++ {
+		if _, err := c.LookupIP(context.Background(), "a.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := make(map[uint16]bool)
+	s.mu.Lock()
+	for _, m := range s.queries {
+		ids[m.ID] = true
+	}
+	s.mu.Unlock()
+	if len(ids) < 2 {
+		t.Fatalf("query ids are not random: %v", ids)
+	}
+}
+
+func TestClientCacheEviction(t *testing.T) {
+	c := NewClient()
+	c.CacheSize = 3
+	c.MinTTL = 0
+	key := func(name string) cacheKey { return cacheKey{name: name, typ: TypeA} }
+	cached := func(name string) bool {
+		_, ok := c.getCache(key(name))
+		return ok
+	}
+
+	c.setCache(key("a"), nil, time.Minute)
+	c.setCache(key("b"), nil, time.Minute)
+	c.setCache(key("c"), nil, time.Minute)
+	cached("a")
+	// 淘汰最久未使用的 b
+	c.setCache(key("d"), nil, time.Minute)
+	if cached("b") || !cached("a") || !cached("c") || !cached("d") {
+		t.Fatal("did not evict the least recently used entry")
+	}
+
+	// 先淘汰过期的记录, 即使它不是最久未使用的
+	c.PurgeCache()
+	c.setCache(key("a"), nil, time.Minute)
+	c.setCache(key("e"), nil, time.Nanosecond)
+	c.setCache(key("b"), nil, time.Minute)
+	time.Sleep(time.Millisecond)
+	c.setCache(key("f"), nil, time.Minute)
+	c.mu.Lock()
+	_, expired := c.cache[key("e")]
+	n := c.lru.Len()
+	c.mu.Unlock()
+	if expired || n != 3 {
+		t.Fatalf("expired entry kept, %d entries", n)
+	}
+	if !cached("a") || !cached("b") || !cached("f") {
+		t.Fatal("evicted a live entry before the expired one")
+	}
+}
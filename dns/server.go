@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"context"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServeTimeout = 10 * time.Second
+	tcpIdleTimeout      = 10 * time.Second
+)
+
+// Handler 处理编码后的 dns 请求, 返回编码后的响应. 返回错误时 Server 响应 SERVFAIL
+type Handler interface {
+	ServeDNS(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// HandlerFunc 把普通函数转换为 Handler
+type HandlerFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+// Server 是本地 dns 服务器, 在同一个地址上监听 UDP 和 TCP
+type Server struct {
+	Handler Handler
+	Timeout time.Duration // 每个请求的超时时间
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	listener net.Listener
+	closed   bool
+}
+
+func NewServer(h Handler) *Server {
+	return &Server{Handler: h, Timeout: defaultServeTimeout}
+}
+
+// ListenAndServe 在 addr 上监听 UDP 和 TCP, 阻塞直到 Close
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.Serve(conn, listener))
+}
+
+// Serve 在 conn(UDP) 和 listener(TCP) 上处理请求, 其中一个可以为 nil, 阻塞直到 Close
+func (s *Server) Serve(conn net.PacketConn, listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("dns server closed")
+	}
+	s.conn, s.listener = conn, listener
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	if conn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveUDP(conn)
+		}()
+	}
+	if listener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveTCP(listener)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) {
+	defer conn.Close()
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !s.isClosed() {
+				log.Error(errors.Trace(err))
+			}
+			return
+		}
+		go func() {
+			if resp := s.handle(buf[:n]); resp != nil {
+				_, _ = conn.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !s.isClosed() {
+				log.Error(errors.Trace(err))
+			}
+			return
+		}
+		go s.serveStream(conn)
+	}
+}
+
+// serveStream 一个连接上可以有多个请求, 按顺序处理
+func (s *Server) serveStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := ReadStreamMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle(query)
+		if resp == nil {
+			return
+		}
+		if err := WriteStreamMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle 返回 nil 表示请求无法解析, 直接丢弃
+func (s *Server) handle(query []byte) []byte {
+	if len(query) < headerLen {
+		return nil
+	}
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	resp, err := s.Handler.ServeDNS(ctx, query)
+	if err == nil {
+		return resp
+	}
+	log.Debugf("serve dns err: %s", err)
+	return ErrorReply(query, RcodeServerFailure)
+}
+
+// ErrorReply 构造 query 的错误响应, query 无法解析时返回 nil
+func ErrorReply(query []byte, rcode uint8) []byte {
+	m, err := Unpack(query)
+	if err != nil {
+		return nil
+	}
+	resp, err := m.Reply(rcode).Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,224 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	maxMessageSize    = 65535
+	mimeDNSMessage    = "application/dns-message"
+	defaultDNSPort    = "53"
+	defaultDoTPort    = "853"
+	defaultDoHTimeout = 10 * time.Second
+)
+
+// Upstream 是上游 dns 服务器, Exchange 发送编码后的请求并返回编码后的响应
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// NewUpstream 由地址构造上游:
+//
+//	8.8.8.8, 8.8.8.8:53, udp://8.8.8.8:53  UDP, 响应被截断时改用 TCP
+//	tcp://8.8.8.8:53
+//	tls://1.1.1.1, tls://dns.google:853    DNS over TLS, 默认端口 853
+//	https://dns.google/dns-query           DNS over HTTPS
+//
+// d 用于连接上游, 为 nil 时直接连接
+func NewUpstream(addr string, d dialer.Dialer) (Upstream, error) {
+	if d == nil {
+		d = dialer.Direct
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch u.Scheme {
+	case "udp":
+		hostport := withDefaultPort(u.Host, defaultDNSPort)
+		return &udpUpstream{addr: hostport, dialer: d, tcp: &tcpUpstream{addr: hostport, dialer: d}}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withDefaultPort(u.Host, defaultDNSPort), dialer: d}, nil
+	case "tls":
+		return &tcpUpstream{
+			addr:   withDefaultPort(u.Host, defaultDoTPort),
+			dialer: d,
+			tls:    &tls.Config{ServerName: u.Hostname()},
+		}, nil
+	case "https":
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Transport: &http.Transport{DialContext: d.DialContext, ForceAttemptHTTP2: true},
+				Timeout:   defaultDoHTimeout,
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream: %s", addr)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+}
+
+type udpUpstream struct {
+	addr   string
+	dialer dialer.Dialer
+	tcp    *tcpUpstream
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < headerLen {
+		return nil, errShortMessage
+	}
+	conn, err := u.dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.Trace(err)
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		// 丢弃 ID 不匹配的响应
+		if n < headerLen || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		// TC
+		if buf[2]&0x02 != 0 {
+			return u.tcp.Exchange(ctx, query)
+		}
+		return append([]byte(nil), buf[:n]...), nil
+	}
+}
+
+func (u *udpUpstream) String() string { return "udp://" + u.addr }
+
+// tcpUpstream 每个请求使用一个新连接, tls 不为空时使用 DNS over TLS
+type tcpUpstream struct {
+	addr   string
+	dialer dialer.Dialer
+	tls    *tls.Config
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	if u.tls != nil {
+		tlsConn := tls.Client(conn, u.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+		conn = tlsConn
+	}
+	return exchangeStream(conn, query)
+}
+
+func (u *tcpUpstream) String() string {
+	if u.tls != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+// exchangeStream 在流式连接上收发报文, 每个报文前有 2 字节的长度
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	if err := WriteStreamMessage(conn, query); err != nil {
+		return nil, errors.Trace(err)
+	}
+	resp, err := ReadStreamMessage(conn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp, nil
+}
+
+// ReadStreamMessage 从 TCP/TLS 连接读取一个带长度前缀的报文
+func ReadStreamMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteStreamMessage 向 TCP/TLS 连接写入一个带长度前缀的报文
+func WriteStreamMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return fmt.Errorf("dns message too long: %d", len(msg))
+	}
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// httpsUpstream DNS over HTTPS (RFC 8484), 使用 POST
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", mimeDNSMessage)
+	req.Header.Set("Accept", mimeDNSMessage)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh %s: %s", u.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return body, nil
+}
+
+func (u *httpsUpstream) String() string { return u.url }
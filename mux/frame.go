@@ -0,0 +1,63 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const version = 1
+
+const (
+	cmdSYN byte = iota // 打开 stream
+	cmdPSH             // 数据
+	cmdFIN             // 关闭写方向, 对端读到 EOF
+	cmdRST             // 关闭 stream, 对端读到 EOF, 写返回错误
+	cmdUPD             // 归还发送窗口, payload 为 4 字节的字节数
+	cmdNOP             // 心跳
+)
+
+const headerSize = 8
+
+// LENGTH 只有 2 字节
+const maxFrameSize = 1<<16 - 1
+
+/**
+  +-----+-----+--------+-----------+---------+
+  | VER | CMD | LENGTH | STREAM ID | PAYLOAD |
+  +-----+-----+--------+-----------+---------+
+  |  1  |  1  |   2    |     4     | LENGTH  |
+  +-----+-----+--------+-----------+---------+
+*/
+type frame struct {
+	cmd     byte
+	sid     uint32
+	payload []byte
+}
+
+func (f *frame) encode() []byte {
+	buf := make([]byte, headerSize+len(f.payload))
+	buf[0] = version
+	buf[1] = f.cmd
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(f.payload)))
+	binary.BigEndian.PutUint32(buf[4:], f.sid)
+	copy(buf[headerSize:], f.payload)
+	return buf
+}
+
+func readFrame(r io.Reader, header []byte) (*frame, error) {
+	if _, err := io.ReadFull(r, header[:headerSize]); err != nil {
+		return nil, err
+	}
+	if header[0] != version {
+		return nil, fmt.Errorf("unsupported mux version: %d", header[0])
+	}
+	f := &frame{cmd: header[1], sid: binary.BigEndian.Uint32(header[4:])}
+	if length := binary.BigEndian.Uint16(header[2:]); length > 0 {
+		f.payload = make([]byte, length)
+		if _, err := io.ReadFull(r, f.payload); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,300 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSessionClosed   = errors.New("mux session closed")
+	ErrSessionDraining = errors.New("mux session draining")
+)
+
+const acceptBacklog = 1024
+
+type Config struct {
+	// 每个 stream 的接收窗口, 对端最多发送这么多未被读取的数据
+	Window int
+	// 单个数据帧的最大长度
+	MaxFrameSize int
+	// 心跳间隔, 超过 KeepAliveTimeout 没有收到任何帧时关闭 session
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Window:            256 * 1024,
+		MaxFrameSize:      32 * 1024,
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveTimeout:  30 * time.Second,
+	}
+}
+
+// Session 在一个连接上复用多个 Stream, 两端都可以打开 Stream.
+// client 打开的 stream id 为奇数, server 为偶数
+type Session struct {
+	conn   net.Conn
+	config *Config
+
+	nextID uint32
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+
+	acceptCh chan *Stream
+	writeMu  sync.Mutex
+
+	lastRecv int64 // unix nano
+
+	// Drain 之后不再打开新的 stream, 所有 stream 关闭后关闭 session
+	draining bool
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// VerifyConfig 检查 Config 是否合法, 帧头中的长度只有 16 位
+func VerifyConfig(config *Config) error {
+	if config.Window <= 0 {
+		return errors.New("window must be positive")
+	}
+	if config.MaxFrameSize <= 0 || config.MaxFrameSize > maxFrameSize {
+		return fmt.Errorf("max frame size must be in (0, %d]", maxFrameSize)
+	}
+	if config.KeepAliveInterval <= 0 || config.KeepAliveTimeout < config.KeepAliveInterval {
+		return errors.New("keepalive timeout must be larger than interval")
+	}
+	return nil
+}
+
+func Client(conn net.Conn, config *Config) (*Session, error) { return newSession(conn, config, 1) }
+
+func Server(conn net.Conn, config *Config) (*Session, error) { return newSession(conn, config, 2) }
+
+func newSession(conn net.Conn, config *Config, firstID uint32) (*Session, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := VerifyConfig(config); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		nextID:   firstID,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, acceptBacklog),
+		lastRecv: time.Now().UnixNano(),
+		die:      make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepAlive()
+	return s, nil
+}
+
+// Open 打开一个新的 Stream
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if s.draining {
+		s.mu.Unlock()
+		return nil, ErrSessionDraining
+	}
+	sid := s.nextID
+	s.nextID += 2
+	stream := newStream(sid, s)
+	s.streams[sid] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(&frame{cmd: cmdSYN, sid: sid}); err != nil {
+		s.removeStream(sid)
+		return nil, errors.Trace(err)
+	}
+	return stream, nil
+}
+
+// Accept 等待对端打开的 Stream
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.die:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Drain 停止接受和打开新的 stream, 等已有的 stream 都关闭后关闭 session
+func (s *Session) Drain() {
+	s.mu.Lock()
+	s.draining = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan 在 session 关闭时被关闭
+func (s *Session) CloseChan() <-chan struct{} { return s.die }
+
+func (s *Session) Close() error {
+	var err error
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, stream := range streams {
+			stream.remoteReset()
+		}
+	})
+	return err
+}
+
+func (s *Session) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *Session) writeFrame(f *frame) error {
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.conn.Write(f.encode()); err != nil {
+		s.Close()
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (s *Session) removeStream(sid uint32) {
+	s.mu.Lock()
+	delete(s.streams, sid)
+	idle := s.draining && len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *Session) getStream(sid uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[sid]
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+	header := make([]byte, headerSize)
+	for {
+		f, err := readFrame(s.conn, header)
+		if err != nil {
+			if !s.IsClosed() {
+				log.Debugf("mux session %s read err: %s", s.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		if err := s.handleFrame(f); err != nil {
+			log.Warnf("mux session %s err: %s", s.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(f *frame) error {
+	switch f.cmd {
+	case cmdNOP:
+	case cmdSYN:
+		s.mu.Lock()
+		if _, ok := s.streams[f.sid]; ok {
+			s.mu.Unlock()
+			return fmt.Errorf("duplicate stream: %d", f.sid)
+		}
+		if s.draining {
+			s.mu.Unlock()
+			return errors.Trace(s.writeFrame(&frame{cmd: cmdRST, sid: f.sid}))
+		}
+		stream := newStream(f.sid, s)
+		s.streams[f.sid] = stream
+		s.mu.Unlock()
+		select {
+		case s.acceptCh <- stream:
+		default:
+			s.removeStream(f.sid)
+			return errors.Trace(s.writeFrame(&frame{cmd: cmdRST, sid: f.sid}))
+		}
+	case cmdPSH:
+		if stream := s.getStream(f.sid); stream != nil && !stream.pushData(f.payload) {
+			// 对端没有遵守窗口, 重置 stream
+			log.Warnf("mux session %s stream %d exceeds window", s.conn.RemoteAddr(), f.sid)
+			s.removeStream(f.sid)
+			stream.remoteReset()
+			return errors.Trace(s.writeFrame(&frame{cmd: cmdRST, sid: f.sid}))
+		}
+	case cmdUPD:
+		if len(f.payload) != 4 {
+			return fmt.Errorf("invalid window update: %d", len(f.payload))
+		}
+		if stream := s.getStream(f.sid); stream != nil {
+			stream.addWindow(int(binary.BigEndian.Uint32(f.payload)))
+		}
+	case cmdFIN:
+		if stream := s.getStream(f.sid); stream != nil {
+			stream.remoteFin()
+		}
+	case cmdRST:
+		if stream := s.getStream(f.sid); stream != nil {
+			s.removeStream(f.sid)
+			stream.remoteReset()
+		}
+	default:
+		return fmt.Errorf("unknown mux cmd: %d", f.cmd)
+	}
+	return nil
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > s.config.KeepAliveTimeout {
+				log.Warnf("mux session %s keepalive timeout", s.conn.RemoteAddr())
+				s.Close()
+				return
+			}
+			_ = s.writeFrame(&frame{cmd: cmdNOP})
+		case <-s.die:
+			return
+		}
+	}
+}
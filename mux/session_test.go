@@ -0,0 +1,137 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerifyConfig(t *testing.T) {
+	config := DefaultConfig()
+	if err := VerifyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxFrameSize = maxFrameSize
+	if err := VerifyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxFrameSize = maxFrameSize + 1
+	if err := VerifyConfig(config); err == nil {
+		t.Fatal("accepted frame size larger than 16 bits")
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, err := Client(c1, config); err == nil {
+		t.Fatal("created session with invalid config")
+	}
+}
+
+func TestStreamLargeWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	config := DefaultConfig()
+	config.MaxFrameSize = maxFrameSize
+	client, err := Client(c1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := Server(c2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	data := make([]byte, 3*maxFrameSize+1)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		stream, err := client.Open()
+		if err != nil {
+			return
+		}
+		stream.Write(data)
+		stream.Close()
+	}()
+	stream, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestStreamExceedsWindow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	config := DefaultConfig()
+	config.Window = 16
+	server, err := Server(c2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// 直接写帧模拟不遵守窗口的对端
+	frames := make(chan *frame, 16)
+	go func() {
+		header := make([]byte, headerSize)
+		for {
+			f, err := readFrame(c1, header)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+	write := func(f *frame) {
+		if _, err := c1.Write(f.encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&frame{cmd: cmdSYN, sid: 1})
+	stream, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(&frame{cmd: cmdPSH, sid: 1, payload: bytes.Repeat([]byte("a"), 10)})
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	// 已读取但没有归还的数据仍然占用窗口
+	write(&frame{cmd: cmdPSH, sid: 1, payload: bytes.Repeat([]byte("b"), 6)})
+	write(&frame{cmd: cmdPSH, sid: 1, payload: []byte("c")})
+
+	timeout := time.After(time.Second)
+	for rst := false; !rst; {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				t.Fatal("session closed")
+			}
+			rst = f.cmd == cmdRST && f.sid == 1
+		case <-timeout:
+			t.Fatal("stream not reset")
+		}
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := stream.Read(buf); err != io.EOF {
+		t.Fatalf("read %d, %v after reset", n, err)
+	}
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Fatal("write succeeded after reset")
+	}
+	if server.IsClosed() {
+		t.Fatal("session closed by one stream")
+	}
+}
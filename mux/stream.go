@@ -0,0 +1,247 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = (*Stream)(nil)
+
+// Stream 是 Session 中的一个双向字节流.
+// 对端最多发送 Config.Window 字节未被读取的数据, 本端读取一半窗口后归还给对端
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	consumed   int // 已读取但还没有归还给对端的字节数
+	sendWindow int
+
+	finRecv bool // 对端关闭了写方向
+	finSent bool
+	closed  bool // 本端调用了 Close
+	reset   bool // 对端关闭了 stream 或 session 已关闭
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		sendWindow: sess.config.Window,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) ID() uint32 { return s.id }
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			s.consumed += n
+			var update int
+			if s.consumed >= s.sess.config.Window/2 {
+				update, s.consumed = s.consumed, 0
+			}
+			reset := s.reset || s.closed
+			s.mu.Unlock()
+			if update > 0 && !reset {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, uint32(update))
+				_ = s.sess.writeFrame(&frame{cmd: cmdUPD, sid: s.id, payload: payload})
+			}
+			return n, nil
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if s.finRecv || s.reset {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		if err := wait(s.readEvent, deadline, s.sess.die); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		s.mu.Lock()
+		if s.closed || s.finSent {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if s.reset {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err := wait(s.writeEvent, deadline, s.sess.die); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > s.sess.config.MaxFrameSize {
+			n = s.sess.config.MaxFrameSize
+		}
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		if err := s.sess.writeFrame(&frame{cmd: cmdPSH, sid: s.id, payload: b[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite 关闭写方向, 对端读完数据后读到 EOF, 本端仍然可以读
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.closed || s.finSent || s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	s.mu.Unlock()
+	notify(s.writeEvent)
+	return s.sess.writeFrame(&frame{cmd: cmdFIN, sid: s.id})
+}
+
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	reset := s.reset
+	s.mu.Unlock()
+	notify(s.readEvent)
+	notify(s.writeEvent)
+	if reset {
+		return nil
+	}
+	// 先通知对端再移除, draining 的 session 在最后一个 stream 移除后关闭
+	err := s.sess.writeFrame(&frame{cmd: cmdRST, sid: s.id})
+	s.sess.removeStream(s.id)
+	return err
+}
+
+func (s *Stream) LocalAddr() net.Addr  { return s.sess.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr { return s.sess.RemoteAddr() }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readEvent)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeEvent)
+	return nil
+}
+
+// pushData 保存对端发送的数据, 未归还的数据超过窗口时丢弃所有数据并返回 false
+func (s *Stream) pushData(data []byte) bool {
+	s.mu.Lock()
+	if s.buf.Len()+s.consumed+len(data) > s.sess.config.Window {
+		s.buf.Reset()
+		s.mu.Unlock()
+		return false
+	}
+	if !s.closed {
+		s.buf.Write(data)
+	}
+	s.mu.Unlock()
+	notify(s.readEvent)
+	return true
+}
+
+func (s *Stream) addWindow(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	notify(s.writeEvent)
+}
+
+func (s *Stream) remoteFin() {
+	s.mu.Lock()
+	s.finRecv = true
+	s.mu.Unlock()
+	notify(s.readEvent)
+}
+
+func (s *Stream) remoteReset() {
+	s.mu.Lock()
+	s.reset = true
+	s.mu.Unlock()
+	notify(s.readEvent)
+	notify(s.writeEvent)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait 等待 event, 超过 deadline 时返回 os.ErrDeadlineExceeded
+func wait(event chan struct{}, deadline time.Time, die chan struct{}) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-event:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-die:
+		// session 关闭时 stream 已被 reset, 回到循环中返回 EOF
+		return nil
+	}
+}
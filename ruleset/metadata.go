@@ -0,0 +1,92 @@
+package ruleset
+
+import (
+	"context"
+	"github.com/obgnail/shadowsocks-toy/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"time"
+)
+
+const resolveTimeout = 5 * time.Second
+
+// Metadata 是规则匹配所需的连接信息
+type Metadata struct {
+	Host    string // 目标域名, 请求为 IP 时为空
+	DstIP   net.IP
+	DstPort int
+	SrcIP   net.IP // 本地 socks5 客户端的地址
+	SrcPort int
+
+	Resolver dns.Resolver // 解析 Host 使用的 Resolver, 为 nil 时使用系统解析器
+
+	resolved bool
+	process  *string
+}
+
+// ResolveIP 返回目标 IP, 只有域名时解析一次并缓存结果, 失败返回 nil
+func (m *Metadata) ResolveIP() net.IP {
+	if m.DstIP != nil || m.resolved {
+		return m.DstIP
+	}
+	m.resolved = true
+	r := m.Resolver
+	if r == nil {
+		r = dns.System
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := r.LookupIP(ctx, m.Host)
+	if err != nil {
+		log.Debugf("resolve %s err: %s", m.Host, err)
+		return nil
+	}
+	if len(ips) > 0 {
+		m.DstIP = ips[0]
+	}
+	return m.DstIP
+}
+
+// ProcessName 返回发起连接的本地进程名, 只在匹配 PROCESS-NAME 规则时查找一次.
+// 来源不是本机时不查找, 失败返回空字符串
+func (m *Metadata) ProcessName() string {
+	if m.process != nil {
+		return *m.process
+	}
+	name, err := lookupProcessName(m.SrcIP, m.SrcPort)
+	if err != nil {
+		log.Debugf("find process of %s:%d err: %s", m.SrcIP, m.SrcPort, err)
+	}
+	m.process = &name
+	return name
+}
+
+func (m *Metadata) String() string {
+	host := m.Host
+	if host == "" {
+		host = m.DstIP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(m.DstPort))
+}
+
+// cacheKey 是决策缓存的 key, 优先使用域名.
+// 规则中有目标端口或来源地址规则时, key 需要包含对应字段. 来源端口和进程名每个连接都不同, 不放进 key, 见 Rules
+func (m *Metadata) cacheKey(f keyFields) string {
+	key := m.Host
+	if key == "" {
+		key = m.DstIP.String()
+	}
+	if f.dstPort {
+		key += "|" + strconv.Itoa(m.DstPort)
+	}
+	if f.srcIP {
+		key += "|" + m.SrcIP.String()
+	}
+	return key
+}
+
+type keyFields struct {
+	dstPort bool
+	srcIP   bool
+}
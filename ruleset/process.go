@@ -0,0 +1,54 @@
+package ruleset
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// 本机地址列表缓存的时间
+const localAddrsTTL = 10 * time.Second
+
+// findProcess 查找进程, 测试时替换
+var findProcess = findProcessName
+
+var localAddrs = struct {
+	mu      sync.Mutex
+	ips     []net.IP
+	expires time.Time
+}{}
+
+// lookupProcessName 查找本地地址为 ip:port 的 socket 所属的进程名.
+// 来源不是本机地址时直接返回空字符串, 不扫描 /proc
+func lookupProcessName(ip net.IP, port int) (string, error) {
+	if ip == nil || !isLocalIP(ip) {
+		return "", nil
+	}
+	return findProcess(ip, port)
+}
+
+// isLocalIP 判断 ip 是否是本机的地址, 只有本机发起的连接才能找到进程
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	localAddrs.mu.Lock()
+	defer localAddrs.mu.Unlock()
+	if now := time.Now(); now.After(localAddrs.expires) {
+		localAddrs.ips = localAddrs.ips[:0]
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok {
+					localAddrs.ips = append(localAddrs.ips, ipNet.IP)
+				}
+			}
+		}
+		localAddrs.expires = now.Add(localAddrsTTL)
+	}
+	for _, local := range localAddrs.ips {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+package ruleset
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// findProcessName 通过 /proc/net/tcp{,6} 找到本地地址为 ip:port 的 socket inode,
+// 再遍历 /proc/<pid>/fd 找到持有该 socket 的进程
+func findProcessName(ip net.IP, port int) (string, error) {
+	inode, err := findSocketInode(ip, port)
+	if err != nil {
+		return "", err
+	}
+	pid, err := findPidBySocket(inode)
+	if err != nil {
+		return "", err
+	}
+	if exe, err := os.Readlink(filepath.Join("/proc", pid, "exe")); err == nil {
+		return filepath.Base(exe), nil
+	}
+	comm, err := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(comm)), nil
+}
+
+func findSocketInode(ip net.IP, port int) (string, error) {
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		inode, err := searchSocketTable(path, ip, port)
+		if err != nil {
+			return "", err
+		}
+		if inode != "" {
+			return inode, nil
+		}
+	}
+	return "", fmt.Errorf("socket %s not found", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+func searchSocketTable(path string, ip net.IP, port int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // 跳过表头
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		localIP, localPort, err := parseHexAddr(fields[1])
+		if err != nil || localPort != port || !localIP.Equal(ip) {
+			continue
+		}
+		return fields[9], nil
+	}
+	return "", scanner.Err()
+}
+
+// parseHexAddr 解析 "0100007F:1F90" 形式的地址, IP 按 32 位一组以主机字节序(小端)存储
+func parseHexAddr(s string) (net.IP, int, error) {
+	idx := strings.IndexByte(s, ':')
+	if idx < 0 {
+		return nil, 0, fmt.Errorf("invalid addr: %s", s)
+	}
+	b, err := hex.DecodeString(s[:idx])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid addr: %s", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	port, err := strconv.ParseUint(s[idx+1:], 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return net.IP(b), int(port), nil
+}
+
+func findPidBySocket(inode string) (string, error) {
+	target := "socket:[" + inode + "]"
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return "", err
+	}
+	for _, proc := range procs {
+		pid := proc.Name()
+		if _, err := strconv.Atoi(pid); err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", pid, "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// 没有权限读取其他用户的进程
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return pid, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("process of %s not found", target)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package ruleset
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func findProcessName(ip net.IP, port int) (string, error) {
+	return "", fmt.Errorf("process lookup is not supported on %s", runtime.GOOS)
+}
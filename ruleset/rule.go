@@ -0,0 +1,173 @@
+package ruleset
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	RuleDomain        = "DOMAIN"
+	RuleDomainSuffix  = "DOMAIN-SUFFIX"
+	RuleDomainKeyword = "DOMAIN-KEYWORD"
+	RuleIPCIDR        = "IP-CIDR"
+	RuleSrcIPCIDR     = "SRC-IP-CIDR"
+	RuleDstPort       = "DST-PORT"
+	RuleSrcPort       = "SRC-PORT"
+	RuleProcessName   = "PROCESS-NAME"
+	RuleMatch         = "MATCH"
+)
+
+type Rule interface {
+	Match(m *Metadata) bool
+	Target() string
+	String() string
+}
+
+type baseRule struct {
+	typ     string
+	payload string
+	target  string
+}
+
+func (r *baseRule) Target() string { return r.target }
+
+func (r *baseRule) String() string {
+	if r.payload == "" {
+		return fmt.Sprintf("%s,%s", r.typ, r.target)
+	}
+	return fmt.Sprintf("%s,%s,%s", r.typ, r.payload, r.target)
+}
+
+type domainRule struct{ baseRule }
+
+func (r *domainRule) Match(m *Metadata) bool {
+	return m.Host != "" && strings.EqualFold(m.Host, r.payload)
+}
+
+type domainSuffixRule struct{ baseRule }
+
+func (r *domainSuffixRule) Match(m *Metadata) bool {
+	host := strings.ToLower(m.Host)
+	return host != "" && (host == r.payload || strings.HasSuffix(host, "."+r.payload))
+}
+
+type domainKeywordRule struct{ baseRule }
+
+func (r *domainKeywordRule) Match(m *Metadata) bool {
+	return m.Host != "" && strings.Contains(strings.ToLower(m.Host), r.payload)
+}
+
+type ipCIDRRule struct {
+	baseRule
+	ipNet *net.IPNet
+}
+
+func (r *ipCIDRRule) Match(m *Metadata) bool {
+	ip := m.ResolveIP()
+	return ip != nil && r.ipNet.Contains(ip)
+}
+
+type srcIPCIDRRule struct {
+	baseRule
+	ipNet *net.IPNet
+}
+
+func (r *srcIPCIDRRule) Match(m *Metadata) bool {
+	return m.SrcIP != nil && r.ipNet.Contains(m.SrcIP)
+}
+
+// portRule 匹配单个端口或端口范围, 如 22, 8000-9000
+type portRule struct {
+	baseRule
+	src        bool
+	start, end int
+}
+
+func (r *portRule) Match(m *Metadata) bool {
+	port := m.DstPort
+	if r.src {
+		port = m.SrcPort
+	}
+	return port >= r.start && port <= r.end
+}
+
+// processRule 按本地进程名匹配, 目前只支持 linux
+type processRule struct{ baseRule }
+
+func (r *processRule) Match(m *Metadata) bool {
+	return m.ProcessName() == r.payload
+}
+
+type matchRule struct{ baseRule }
+
+func (r *matchRule) Match(m *Metadata) bool { return true }
+
+// ParseRule 解析形如 "DOMAIN-SUFFIX,google.com,PROXY" 的规则, MATCH 规则省略 payload
+func ParseRule(line string) (Rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	typ := strings.ToUpper(fields[0])
+	if typ == RuleMatch {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid rule: %s", line)
+		}
+		return &matchRule{baseRule{typ: typ, target: fields[1]}}, nil
+	}
+	if len(fields) != 3 || fields[1] == "" || fields[2] == "" {
+		return nil, fmt.Errorf("invalid rule: %s", line)
+	}
+	base := baseRule{typ: typ, payload: strings.ToLower(fields[1]), target: fields[2]}
+	switch typ {
+	case RuleDomain:
+		return &domainRule{base}, nil
+	case RuleDomainSuffix:
+		return &domainSuffixRule{base}, nil
+	case RuleDomainKeyword:
+		return &domainKeywordRule{base}, nil
+	case RuleIPCIDR:
+		_, ipNet, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule: %s: %s", line, err)
+		}
+		return &ipCIDRRule{base, ipNet}, nil
+	case RuleSrcIPCIDR:
+		_, ipNet, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule: %s: %s", line, err)
+		}
+		return &srcIPCIDRRule{base, ipNet}, nil
+	case RuleDstPort, RuleSrcPort:
+		start, end, err := parsePortRange(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule: %s: %s", line, err)
+		}
+		return &portRule{base, typ == RuleSrcPort, start, end}, nil
+	case RuleProcessName:
+		// 进程名区分大小写
+		base.payload = fields[1]
+		return &processRule{base}, nil
+	default:
+		return nil, fmt.Errorf("unknown rule type: %s", typ)
+	}
+}
+
+func parsePortRange(s string) (start, end int, err error) {
+	from, to := s, s
+	if idx := strings.Index(s, "-"); idx >= 0 {
+		from, to = s[:idx], s[idx+1:]
+	}
+	if start, err = strconv.Atoi(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = strconv.Atoi(to); err != nil {
+		return 0, 0, err
+	}
+	if start < 0 || end > 0xffff || start > end {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,159 @@
+package ruleset
+
+import (
+	"github.com/juju/errors"
+	"sync/atomic"
+)
+
+var _ Ruleset = (*Rules)(nil)
+
+// noRule 表示没有规则命中, 走 TargetDirect
+const noRule = -1
+
+// Rules 按顺序匹配规则, 第一个命中的规则决定出站.
+// 匹配结果按域名/IP 缓存在 LRU 中, 每条规则记录命中次数.
+// SRC-PORT 和 PROCESS-NAME 的结果每个连接都不同, 不放进缓存的 key, 缓存只跳过它们之前没有命中的规则,
+// 进程名只在匹配到 PROCESS-NAME 规则时才查找.
+type Rules struct {
+	rules []Rule
+	hits  []uint64
+	cache *lruCache // nil 表示不缓存
+
+	// 决策缓存的 key 需要包含的字段
+	keyFields keyFields
+
+	cacheHits   uint64
+	cacheMisses uint64
+}
+
+// decision 是缓存的匹配结果. resume 为 true 时 idx 是第一条依赖单个连接的规则, 之前的规则都没有命中,
+// 命中缓存后从 idx 继续匹配
+type decision struct {
+	idx    int
+	resume bool
+}
+
+type RuleStat struct {
+	Rule string
+	Hits uint64
+}
+
+// NewRules cacheSize <= 0 时不缓存匹配结果
+func NewRules(rules []Rule, cacheSize int) *Rules {
+	r := &Rules{rules: rules, hits: make([]uint64, len(rules))}
+	for _, rule := range rules {
+		switch rule := rule.(type) {
+		case *portRule:
+			if !rule.src {
+				r.keyFields.dstPort = true
+			}
+		case *srcIPCIDRRule:
+			r.keyFields.srcIP = true
+		}
+	}
+	if cacheSize > 0 {
+		r.cache = newLRUCache(cacheSize)
+	}
+	return r
+}
+
+func ParseRules(lines []string, cacheSize int) (*Rules, error) {
+	rules := make([]Rule, 0, len(lines))
+	for _, line := range lines {
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rules = append(rules, rule)
+	}
+	return NewRules(rules, cacheSize), nil
+}
+
+func (r *Rules) Match(m *Metadata) string {
+	idx := r.match(m)
+	if idx == noRule {
+		return TargetDirect
+	}
+	atomic.AddUint64(&r.hits[idx], 1)
+	return r.rules[idx].Target()
+}
+
+func (r *Rules) match(m *Metadata) int {
+	if r.cache == nil {
+		idx, _ := r.find(m, 0)
+		return idx
+	}
+	key := m.cacheKey(r.keyFields)
+	if d, ok := r.cache.Get(key); ok {
+		atomic.AddUint64(&r.cacheHits, 1)
+		if !d.resume {
+			return d.idx
+		}
+		idx, _ := r.find(m, d.idx)
+		return idx
+	}
+	atomic.AddUint64(&r.cacheMisses, 1)
+	idx, volatile := r.find(m, 0)
+	if volatile == noRule {
+		r.cache.Add(key, decision{idx: idx})
+	} else {
+		r.cache.Add(key, decision{idx: volatile, resume: true})
+	}
+	return idx
+}
+
+// find 从第 from 条规则开始匹配, volatile 是匹配过程中经过的第一条依赖单个连接的规则, 没有时为 noRule
+func (r *Rules) find(m *Metadata, from int) (idx, volatile int) {
+	volatile = noRule
+	for idx := from; idx < len(r.rules); idx++ {
+		rule := r.rules[idx]
+		if volatile == noRule && perConn(rule) {
+			volatile = idx
+		}
+		if rule.Match(m) {
+			return idx, volatile
+		}
+	}
+	return noRule, volatile
+}
+
+// perConn 判断 rule 的结果是否依赖单个连接的信息, 例如每个连接都不同的来源端口和发起连接的进程
+func perConn(rule Rule) bool {
+	switch rule := rule.(type) {
+	case *portRule:
+		return rule.src
+	case *processRule:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stats 按规则顺序返回每条规则的命中次数
+func (r *Rules) Stats() []RuleStat {
+	stats := make([]RuleStat, len(r.rules))
+	for idx, rule := range r.rules {
+		stats[idx] = RuleStat{Rule: rule.String(), Hits: atomic.LoadUint64(&r.hits[idx])}
+	}
+	return stats
+}
+
+// CacheStats 返回决策缓存的命中和未命中次数
+func (r *Rules) CacheStats() (hits, misses uint64) {
+	return atomic.LoadUint64(&r.cacheHits), atomic.LoadUint64(&r.cacheMisses)
+}
+
+func (r *Rules) ResetStats() {
+	for idx := range r.hits {
+		atomic.StoreUint64(&r.hits[idx], 0)
+	}
+	atomic.StoreUint64(&r.cacheHits, 0)
+	atomic.StoreUint64(&r.cacheMisses, 0)
+}
+
+// PurgeCache 清空决策缓存, 例如 DNS 变化导致 IP-CIDR 规则结果失效时
+func (r *Rules) PurgeCache() {
+	if r.cache != nil {
+		r.cache.Purge()
+	}
+}
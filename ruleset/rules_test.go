@@ -0,0 +1,284 @@
+package ruleset
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want string // String() 的结果, 为空表示解析失败
+	}{
+		{"DOMAIN,www.Google.com,PROXY", "DOMAIN,www.google.com,PROXY"},
+		{"domain-suffix, google.com , PROXY", "DOMAIN-SUFFIX,google.com,PROXY"},
+		{"DOMAIN-KEYWORD,ads,REJECT", "DOMAIN-KEYWORD,ads,REJECT"},
+		{"IP-CIDR,10.0.0.0/8,DIRECT", "IP-CIDR,10.0.0.0/8,DIRECT"},
+		{"PROCESS-NAME,Telegram,PROXY", "PROCESS-NAME,Telegram,PROXY"},
+		{"MATCH,PROXY", "MATCH,PROXY"},
+		{"MATCH,a,PROXY", ""},
+		{"DOMAIN,google.com", ""},
+		{"DOMAIN,,PROXY", ""},
+		{"IP-CIDR,10.0.0.0,DIRECT", ""},
+		{"GEOIP,CN,DIRECT", ""},
+	} {
+		rule, err := ParseRule(tc.line)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("ParseRule(%q) = %s, want error", tc.line, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", tc.line, err)
+			continue
+		}
+		if got := rule.String(); got != tc.want {
+			t.Errorf("ParseRule(%q) = %s, want %s", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestRulesMatch(t *testing.T) {
+	r, err := ParseRules([]string{
+		"DOMAIN,exact.test,REJECT",
+		"DOMAIN-SUFFIX,google.com,PROXY",
+		"DOMAIN-KEYWORD,ads,REJECT",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"MATCH,PROXY",
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		m    *Metadata
+		want string
+	}{
+		{&Metadata{Host: "EXACT.test"}, TargetReject},
+		{&Metadata{Host: "sub.exact.test", DstIP: net.ParseIP("1.1.1.1")}, TargetProxy},
+		{&Metadata{Host: "google.com"}, TargetProxy},
+		{&Metadata{Host: "www.google.com"}, TargetProxy},
+		{&Metadata{Host: "notgoogle.com", DstIP: net.ParseIP("1.1.1.1")}, TargetProxy},
+		{&Metadata{Host: "myads.example"}, TargetReject},
+		{&Metadata{DstIP: net.ParseIP("10.1.2.3")}, TargetDirect},
+	} {
+		if got := r.Match(tc.m); got != tc.want {
+			t.Errorf("Match(%s) = %s, want %s", tc.m, got, tc.want)
+		}
+	}
+
+	// 没有规则命中时 DIRECT
+	empty, err := ParseRules(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := empty.Match(&Metadata{DstIP: net.ParseIP("1.1.1.1")}); got != TargetDirect {
+		t.Errorf("empty rules match %s", got)
+	}
+	if _, err := ParseRules([]string{"MATCH,PROXY", "BAD"}, 0); err == nil {
+		t.Error("ParseRules accepted an invalid rule")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.Add("a", decision{idx: 1})
+	c.Add("b", decision{idx: 2})
+	// a 变为最近使用, 加入 c 时淘汰 b
+	if v, ok := c.Get("a"); !ok || v.idx != 1 {
+		t.Fatalf("get a = %+v %v", v, ok)
+	}
+	c.Add("c", decision{idx: 3})
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b not evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v.idx != 1 {
+		t.Fatalf("get a = %+v %v", v, ok)
+	}
+	c.Add("a", decision{idx: 4, resume: true})
+	if v, _ := c.Get("a"); v != (decision{idx: 4, resume: true}) || c.Len() != 2 {
+		t.Fatalf("update a = %+v, len %d", v, c.Len())
+	}
+	c.Purge()
+	if _, ok := c.Get("a"); ok || c.Len() != 0 {
+		t.Fatal("purge left entries")
+	}
+}
+
+func TestRulesCacheAndStats(t *testing.T) {
+	r, err := ParseRules([]string{
+		"DOMAIN-SUFFIX,a.test,PROXY",
+		"DOMAIN-SUFFIX,b.test,REJECT",
+		"MATCH,DIRECT",
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"a.test", "a.test", "b.test", "a.test", "c.test", "b.test"} {
+		r.Match(&Metadata{Host: host, DstIP: net.ParseIP("1.1.1.1")})
+	}
+	// a.test 第一次未命中, 之后两次命中; c.test 加入时淘汰 b.test, 第二次 b.test 未命中
+	hits, misses := r.CacheStats()
+	if hits != 2 || misses != 4 {
+		t.Fatalf("cache hits %d misses %d", hits, misses)
+	}
+	// 缓存命中的决策也计入规则的命中次数
+	want := []RuleStat{
+		{"DOMAIN-SUFFIX,a.test,PROXY", 3},
+		{"DOMAIN-SUFFIX,b.test,REJECT", 2},
+		{"MATCH,DIRECT", 1},
+	}
+	stats := r.Stats()
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("stats[%d] = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+
+	r.ResetStats()
+	if hits, misses := r.CacheStats(); hits != 0 || misses != 0 || r.Stats()[0].Hits != 0 {
+		t.Fatal("stats not reset")
+	}
+	r.PurgeCache()
+	r.Match(&Metadata{Host: "a.test"})
+	if hits, misses := r.CacheStats(); hits != 0 || misses != 1 {
+		t.Fatalf("after purge hits %d misses %d", hits, misses)
+	}
+}
+
+func TestParsePortAndSourceRules(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		ok   bool
+	}{
+		{"DST-PORT,22,DIRECT", true},
+		{"DST-PORT,8000-9000,PROXY", true},
+		{"SRC-PORT,0-1023,REJECT", true},
+		{"SRC-IP-CIDR,192.168.1.0/24,DIRECT", true},
+		{"SRC-IP-CIDR,fd00::/8,DIRECT", true},
+		{"DST-PORT,9000-8000,PROXY", false},
+		{"DST-PORT,65536,PROXY", false},
+		{"DST-PORT,-1,PROXY", false},
+		{"DST-PORT,http,PROXY", false},
+		{"SRC-PORT,1-,PROXY", false},
+		{"SRC-IP-CIDR,192.168.1.1,DIRECT", false},
+	} {
+		if _, err := ParseRule(tc.line); (err == nil) != tc.ok {
+			t.Errorf("ParseRule(%q) err = %v, want ok %v", tc.line, err, tc.ok)
+		}
+	}
+}
+
+func TestPortAndSourceRulesMatch(t *testing.T) {
+	r, err := ParseRules([]string{
+		"DST-PORT,22,DIRECT",
+		"DST-PORT,8000-9000,REJECT",
+		"SRC-IP-CIDR,192.168.1.0/24,DIRECT",
+		"SRC-PORT,0-1023,REJECT",
+		"MATCH,PROXY",
+	}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := net.ParseIP("10.0.0.2")
+	for _, tc := range []struct {
+		m    *Metadata
+		want string
+	}{
+		{&Metadata{Host: "a.test", DstPort: 22, SrcIP: src, SrcPort: 40000}, TargetDirect},
+		{&Metadata{Host: "a.test", DstPort: 8000, SrcIP: src, SrcPort: 40000}, TargetReject},
+		{&Metadata{Host: "a.test", DstPort: 9000, SrcIP: src, SrcPort: 40000}, TargetReject},
+		{&Metadata{Host: "a.test", DstPort: 9001, SrcIP: src, SrcPort: 40000}, TargetProxy},
+		{&Metadata{Host: "a.test", DstPort: 443, SrcIP: net.ParseIP("192.168.1.7"), SrcPort: 40000}, TargetDirect},
+		{&Metadata{Host: "a.test", DstPort: 443, SrcIP: src, SrcPort: 1000}, TargetReject},
+		// 与上一个连接的 key 相同, 缓存不能把来源端口的结果用在这里
+		{&Metadata{Host: "a.test", DstPort: 443, SrcIP: src, SrcPort: 40001}, TargetProxy},
+		{&Metadata{Host: "a.test", DstPort: 443, SrcIP: src, SrcPort: 1001}, TargetReject},
+	} {
+		if got := r.Match(tc.m); got != tc.want {
+			t.Errorf("Match(%s from %s:%d) = %s, want %s", tc.m, tc.m.SrcIP, tc.m.SrcPort, got, tc.want)
+		}
+	}
+}
+
+func TestSrcPortNotInCacheKey(t *testing.T) {
+	r, err := ParseRules([]string{
+		"DOMAIN,a.test,DIRECT",
+		"SRC-PORT,0-1023,REJECT",
+		"MATCH,PROXY",
+	}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := net.ParseIP("10.0.0.2")
+	for port := 40000; port < 40100; port++ {
+		if got := r.Match(&Metadata{Host: "b.test", SrcIP: src, SrcPort: port}); got != TargetProxy {
+			t.Fatalf("port %d match %s", port, got)
+		}
+	}
+	// 每个来源端口不会各占一条缓存
+	if n := r.cache.Len(); n != 1 {
+		t.Fatalf("%d cache entries", n)
+	}
+	if hits, misses := r.CacheStats(); hits != 99 || misses != 1 {
+		t.Fatalf("cache hits %d misses %d", hits, misses)
+	}
+	// 来源端口之前就命中的决策不受影响
+	r.Match(&Metadata{Host: "a.test", SrcIP: src, SrcPort: 1})
+	if got := r.Match(&Metadata{Host: "a.test", SrcIP: src, SrcPort: 2}); got != TargetDirect {
+		t.Fatalf("a.test match %s", got)
+	}
+}
+
+// stubProcess 把进程查找替换为 names, 返回查找的次数
+func stubProcess(t *testing.T, names map[int]string) *int {
+	t.Helper()
+	calls := new(int)
+	old := findProcess
+	findProcess = func(ip net.IP, port int) (string, error) {
+		*calls++
+		return names[port], nil
+	}
+	t.Cleanup(func() { findProcess = old })
+	return calls
+}
+
+func TestProcessNameRule(t *testing.T) {
+	calls := stubProcess(t, map[int]string{40000: "git", 40001: "curl"})
+	r, err := ParseRules([]string{
+		"DOMAIN-SUFFIX,direct.test,DIRECT",
+		"PROCESS-NAME,git,PROXY",
+		"MATCH,REJECT",
+	}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := net.ParseIP("127.0.0.1")
+	for _, tc := range []struct {
+		m     *Metadata
+		want  string
+		calls int
+	}{
+		// 前面的规则命中时不查找进程
+		{&Metadata{Host: "www.direct.test", SrcIP: local, SrcPort: 40000}, TargetDirect, 0},
+		{&Metadata{Host: "www.direct.test", SrcIP: local, SrcPort: 40001}, TargetDirect, 0},
+		{&Metadata{Host: "a.test", SrcIP: local, SrcPort: 40000}, TargetProxy, 1},
+		// 命中缓存时仍然按这个连接的进程匹配
+		{&Metadata{Host: "a.test", SrcIP: local, SrcPort: 40001}, TargetReject, 2},
+		{&Metadata{Host: "a.test", SrcIP: local, SrcPort: 40000}, TargetProxy, 3},
+		// 来源不是本机时不查找
+		{&Metadata{Host: "a.test", SrcIP: net.ParseIP("203.0.113.1"), SrcPort: 40000}, TargetReject, 3},
+		{&Metadata{Host: "a.test", SrcPort: 40000}, TargetReject, 3},
+	} {
+		if got := r.Match(tc.m); got != tc.want {
+			t.Errorf("Match(%s from %s:%d) = %s, want %s", tc.m, tc.m.SrcIP, tc.m.SrcPort, got, tc.want)
+		}
+		if *calls != tc.calls {
+			t.Errorf("Match(%s from %s:%d) looked up process %d times in total, want %d",
+				tc.m, tc.m.SrcIP, tc.m.SrcPort, *calls, tc.calls)
+		}
+	}
+	if n := r.cache.Len(); n != 2 {
+		t.Fatalf("%d cache entries", n)
+	}
+}
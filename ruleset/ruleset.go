@@ -1,17 +1,24 @@
 package ruleset
 
-import "net"
+const (
+	TargetProxy  = "PROXY"
+	TargetDirect = "DIRECT"
+	TargetReject = "REJECT"
+)
 
+// Ruleset 决定连接的出站: TargetProxy, TargetDirect, TargetReject 或 Client 中的 Server 组名
 type Ruleset interface {
-	Match(addr *net.TCPAddr) bool
+	Match(m *Metadata) string
 }
 
-type RuleFunc func(addr *net.TCPAddr) bool
+type RuleFunc func(m *Metadata) string
+
+func (f RuleFunc) Match(m *Metadata) string { return f(m) }
 
 type Global struct{}
 
-func (g *Global) Match(addr *net.TCPAddr) bool { return true }
+func (g *Global) Match(m *Metadata) string { return TargetProxy }
 
 type Direct struct{}
 
-func (d *Direct) Match(addr *net.TCPAddr) bool { return false }
+func (d *Direct) Match(m *Metadata) string { return TargetDirect }
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	"github.com/obgnail/shadowsocks-toy/mux"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// serveReverse 处理 mux stream 中的 BIND: 在 addr 上监听, 每个连接在 session 中打开一个 stream 转发给 client,
+// stream 开头是连接的来源地址. client 关闭控制 stream 或 session 断开时停止监听
+func (s *Server) serveReverse(userConn *connection.SecureSocket, session *mux.Session, addr *connection.Addr) {
+	if !s.Reverse || session == nil {
+		_ = connection.ReplyRequest(userConn, connection.RepCommandNotSupported)
+		log.Warnf("%s -> %s | reverse tunnel %s not allowed", logger.ClientStr, logger.ServerStr, addr)
+		return
+	}
+	if !s.reverseAllowed(addr) {
+		_ = connection.ReplyRequest(userConn, connection.RepNotAllowed)
+		log.Warnf("%s -> %s | reverse tunnel %s not in ReverseAllow", logger.ClientStr, logger.ServerStr, addr)
+		return
+	}
+	listener, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		_ = connection.ReplyRequest(userConn, connection.RepGeneralFailure)
+		logError(err)
+		return
+	}
+	if err := connection.ReplyRequest(userConn, connection.RepSucceeded); err != nil {
+		listener.Close()
+		logError(err)
+		return
+	}
+	control := userConn.Hijack()
+	_ = control.SetDeadline(time.Time{})
+	go func() {
+		// client 不会在控制 stream 上发送数据, 读到 EOF 或出错表示反向隧道被注销
+		_, _ = io.Copy(io.Discard, control)
+		listener.Close()
+	}()
+
+	log.Info("Server Reverse Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()), " <- ", session.RemoteAddr())
+	err = s.acceptor.Serve(context.Background(), listener, func(conn net.Conn) {
+		s.handleReverseConn(session, conn)
+	})
+	log.Debugf("%s <-> %s | %s reverse tunnel closed: %v", logger.ClientStr, logger.ServerStr, listener.Addr(), err)
+}
+
+// reverseAllowed 检查 addr 是否匹配 ReverseAllow 中的地址, 端口需要相同, 地址为空时匹配任意地址
+func (s *Server) reverseAllowed(addr *connection.Addr) bool {
+	for _, allow := range s.ReverseAllow {
+		a, err := connection.NewAddr(allow)
+		if err != nil || a.Port != addr.Port {
+			continue
+		}
+		switch {
+		case a.IP != nil:
+			if a.IP.Equal(addr.IP) {
+				return true
+			}
+		case a.Host == "" || strings.EqualFold(a.Host, addr.Host):
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleReverseConn(session *mux.Session, conn net.Conn) {
+	defer conn.Close()
+	stream, err := session.Open()
+	if err != nil {
+		logError(err)
+		return
+	}
+	defer stream.Close()
+	src, err := connection.NewAddr(conn.RemoteAddr().String())
+	if err != nil {
+		logError(err)
+		return
+	}
+	if _, err := stream.Write(src.Bytes()); err != nil {
+		logError(err)
+		return
+	}
+	log.Debugf(
+		"%s -> %s -> %s | %s -> %s reverse",
+		logger.TargetStr, logger.ServerStr, logger.ClientStr, conn.RemoteAddr(), conn.LocalAddr(),
+	)
+
+	watchdog := connection.NewWatchdog(s.IdleTimeout, s.MaxSessionDuration, func(reason string) {
+		log.Debugf("%s <-> %s | %s <-> %s %s", logger.TargetStr, logger.ClientStr, conn.RemoteAddr(), session.RemoteAddr(), reason)
+		conn.Close()
+		stream.Close()
+	})
+	defer watchdog.Stop()
+	if err := connection.Copy(connection.WatchConn(conn, watchdog), connection.WatchConn(stream, watchdog)); err != nil {
+		logError(err)
+	}
+}
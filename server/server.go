@@ -1,18 +1,60 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/juju/errors"
 	"github.com/obgnail/shadowsocks-toy/cipher"
 	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/dns"
 	"github.com/obgnail/shadowsocks-toy/logger"
+	"github.com/obgnail/shadowsocks-toy/mux"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"time"
+)
+
+const (
+	defaultDialTimeout      = 10 * time.Second
+	defaultHandshakeTimeout = time.Minute
+	defaultIdleTimeout      = 5 * time.Minute
+	defaultUDPTimeout       = time.Minute
 )
 
 type Server struct {
 	cipher     cipher.Cipher
 	listenAddr *net.TCPAddr
+
+	// 是否允许 client 使用多路复用, 默认允许
+	Mux       bool
+	MuxConfig *mux.Config
+
+	// 连接目标使用的 Dialer, 为 nil 时直接连接
+	Dialer      dialer.Dialer
+	DialTimeout time.Duration
+	// 解析目标域名使用的 Resolver, 为 nil 时由 Dialer 解析
+	Resolver dns.Resolver
+
+	// 是否允许 client 使用 UDP relay, 默认允许
+	UDP bool
+	// UDP relay 空闲超过 UDPTimeout 时关闭
+	UDPTimeout time.Duration
+	// 是否允许 client 通过 mux 注册反向隧道, 默认不允许. 开启后也只能监听 ReverseAllow 中的地址
+	Reverse bool
+	// 允许反向隧道监听的地址, 格式为 host:port, host 为空时匹配任意地址上的该端口, 例如 ":8080", "127.0.0.1:9000".
+	// 为空时拒绝所有反向隧道
+	ReverseAllow []string
+
+	// 从建立连接到收到 request 的超时时间, 需要大于 client 连接池的 PoolMaxAge
+	HandshakeTimeout time.Duration
+	// 隧道空闲超过 IdleTimeout 时关闭, 任意方向有数据时重新计时
+	IdleTimeout time.Duration
+	// 隧道的最长存活时间, 0 表示不限制
+	MaxSessionDuration time.Duration
+
+	acceptor connection.Acceptor
 }
 
 func New(listenAddr string, c cipher.Cipher) (*Server, error) {
@@ -20,69 +62,234 @@ func New(listenAddr string, c cipher.Cipher) (*Server, error) {
 		c = &cipher.NopCipher{}
 	}
 
-	lAddr, err := net.ResolveTCPAddr("tcp4", listenAddr)
-	if err != nil {
-		return nil, err
+	s := &Server{
+		cipher:           c,
+		Mux:              true,
+		UDP:              true,
+		UDPTimeout:       defaultUDPTimeout,
+		DialTimeout:      defaultDialTimeout,
+		HandshakeTimeout: defaultHandshakeTimeout,
+		IdleTimeout:      defaultIdleTimeout,
+	}
+	// listenAddr 为空时只能使用 Serve
+	if listenAddr != "" {
+		lAddr, err := net.ResolveTCPAddr("tcp4", listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		s.listenAddr = lAddr
 	}
-	return &Server{listenAddr: lAddr, cipher: c}, nil
+	return s, nil
 }
 
 func (s *Server) Listen(didListen func(listenAddr *net.TCPAddr)) error {
-	listener, err := net.ListenTCP("tcp", s.listenAddr)
+	listener, err := s.listen()
 	if err != nil {
 		return errors.Trace(err)
 	}
-	log.Info("Server Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()))
 	if didListen != nil {
 		go didListen(s.listenAddr)
 	}
-	s.startListen(listener)
-	return nil
+	return errors.Trace(s.serve(context.Background(), listener))
 }
 
-func (s *Server) startListen(listener net.Listener) {
-	for {
-		userConn, err := listener.Accept()
-		if err != nil {
-			continue
+// ListenAndServe 监听并处理连接, 直到 ctx 被取消或调用 Shutdown/Close. ctx 被取消时立即关闭所有连接
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listener, err := s.listen()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.serve(ctx, listener))
+}
+
+// Serve 在调用者提供的 listener 上处理连接, 例如 unix socket, systemd socket activation 或包装了 TLS 的 listener.
+// 与 ListenAndServe 一样阻塞直到 ctx 被取消或调用 Shutdown/Close, listener 在别处被关闭时返回错误.
+// 无论如何返回, listener 都已被关闭
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	return errors.Trace(s.serve(ctx, listener))
+}
+
+// Shutdown 停止接受新连接, 等待正在转发的隧道结束. ctx 结束时强制关闭剩下的连接并返回 ctx.Err().
+// 多路复用的 session 不再接受新的 stream, 已有的 stream 都结束后关闭
+func (s *Server) Shutdown(ctx context.Context) error {
+	return errors.Trace(s.acceptor.Shutdown(ctx))
+}
+
+// Close 停止接受新连接并立即关闭所有连接
+func (s *Server) Close() error {
+	return errors.Trace(s.acceptor.Close())
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	if s.listenAddr == nil {
+		return nil, fmt.Errorf("no listen addr")
+	}
+	listener, err := net.ListenTCP("tcp", s.listenAddr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
+
+func (s *Server) serve(ctx context.Context, listener net.Listener) error {
+	if s.Mux && s.MuxConfig != nil {
+		if err := mux.VerifyConfig(s.MuxConfig); err != nil {
+			listener.Close()
+			return errors.Trace(err)
+		}
+	}
+	for _, allow := range s.ReverseAllow {
+		if _, err := connection.NewAddr(allow); err != nil {
+			listener.Close()
+			return errors.Annotatef(err, "reverse allow %q", allow)
 		}
-		log.Debugf("%s -> %s | %s -> %s", logger.ClientStr, logger.ServerStr, userConn.RemoteAddr(), userConn.LocalAddr())
-		go s.handleConn(userConn)
 	}
+	log.Info("Server Listen ", fmt.Sprintf(logger.GreenBackWhiteTextFormat, listener.Addr()))
+	return s.acceptor.Serve(ctx, listener, func(userConn net.Conn) {
+		log.Debugf("%s -> %s | %s -> %s", logger.ClientStr, logger.ServerStr, userConn.RemoteAddr(), userConn.LocalAddr())
+		s.handleConn(userConn)
+	})
 }
 
 func (s *Server) handleConn(conn net.Conn) {
 	userConn := connection.NewSecureSocket(conn, s.cipher)
 	defer userConn.Close()
 
-	dstConn, err := s.sock5(userConn)
+	s.setHandshakeDeadline(conn)
+	_, methods, err := connection.ReadHandshake(userConn)
 	if err != nil {
-		log.Error(errors.Trace(err))
+		logError(err)
+		return
+	}
+	if s.Mux && bytes.IndexByte(methods, connection.MethodMux) != -1 {
+		if err := connection.ReplyHandshake(userConn, connection.MethodMux); err != nil {
+			logError(err)
+			return
+		}
+		// session 由心跳保活
+		_ = conn.SetDeadline(time.Time{})
+		s.serveMux(userConn)
+		return
+	}
+	if err := connection.ReplyHandshake(userConn, connection.MethodNoAuth); err != nil {
+		logError(err)
 		return
 	}
+	s.serveRequest(userConn, s.cipher, nil)
+}
+
+// serveMux 把连接作为多路复用的 session, 每个 stream 是一个明文的 socks5 连接
+func (s *Server) serveMux(userConn *connection.SecureSocket) {
+	session, err := mux.Server(connection.NewPlainConn(userConn), s.MuxConfig)
+	if err != nil {
+		logError(err)
+		return
+	}
+	defer session.Close()
+	log.Debugf("%s <-> %s | %s <-> %s mux session", logger.ClientStr, logger.ServerStr, userConn.RemoteAddr(), userConn.LocalAddr())
+	go func() {
+		select {
+		case <-s.acceptor.ShutdownChan():
+			session.Drain()
+		case <-session.CloseChan():
+		}
+	}()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleStream(session, stream)
+	}
+}
+
+// handleStream stream 已经在加密的 session 中, 本身不再加密
+func (s *Server) handleStream(session *mux.Session, stream *mux.Stream) {
+	nop := cipher.NewNopCipher()
+	userConn := connection.NewSecureSocket(stream, nop)
+	defer userConn.Close()
+
+	s.setHandshakeDeadline(stream)
+	if _, err := connection.HandShakeHandler(userConn); err != nil {
+		logError(err)
+		return
+	}
+	s.serveRequest(userConn, nop, session)
+}
+
+// serveRequest c 是 userConn 使用的 cipher, 在 mux stream 中时 session 是 stream 所在的 session, 否则为 nil
+func (s *Server) serveRequest(userConn *connection.SecureSocket, c cipher.Cipher, session *mux.Session) {
+	_, cmd, addr, err := connection.ReadCommand(userConn)
+	if err != nil {
+		logError(err)
+		return
+	}
+	switch cmd {
+	case connection.CmdUDPAssociate:
+		s.serveUDP(userConn, addr)
+		return
+	case connection.CmdBind:
+		s.serveReverse(userConn, session, addr)
+		return
+	}
+	d := s.Dialer
+	if s.Resolver != nil {
+		d = dns.NewDialer(s.Resolver, d)
+	}
+	dst, err := dialer.Dial(d, s.DialTimeout, "tcp", addr.String())
+	if err != nil {
+		_ = connection.ReplyRequest(userConn, connection.RepHostUnreachable)
+		logError(err)
+		return
+	}
+	// Conn被关闭时直接清除所有数据 不管没有发送的数据
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	if err := connection.ReplyRequest(userConn, connection.RepSucceeded); err != nil {
+		dst.Close()
+		logError(err)
+		return
+	}
+	log.Debugf("%s -> %s | %s -> %s", logger.ServerStr, logger.TargetStr, dst.LocalAddr(), dst.RemoteAddr())
+	if err := userConn.SetDeadline(time.Time{}); err != nil {
+		dst.Close()
+		logError(err)
+		return
+	}
+
+	user := userConn.Hijack()
+	watchdog := connection.NewWatchdog(s.IdleTimeout, s.MaxSessionDuration, func(reason string) {
+		log.Debugf("%s <-> %s | %s <-> %s %s", logger.ClientStr, logger.TargetStr, user.RemoteAddr(), dst.RemoteAddr(), reason)
+		user.Close()
+		dst.Close()
+	})
+	defer watchdog.Stop()
+	cipherConn := connection.NewSecureSocket(connection.WatchConn(user, watchdog), c)
+	dstConn := connection.NewSecureSocket(connection.WatchConn(dst, watchdog), c)
 	defer dstConn.Close()
 
 	log.Debugf(
 		"%s <-> %s <-> %s | %s <-> %s(%s) <-> %s",
 		logger.ClientStr, logger.ServerStr, logger.TargetStr,
-		userConn.RemoteAddr(), userConn.LocalAddr(), dstConn.LocalAddr(), dstConn.RemoteAddr(),
+		cipherConn.RemoteAddr(), cipherConn.LocalAddr(), dstConn.LocalAddr(), dstConn.RemoteAddr(),
 	)
-	err = connection.Tunnel(userConn, dstConn)
-	if err != nil {
+	if err := connection.Tunnel(cipherConn, dstConn); err != nil {
 		log.Error(errors.Trace(err))
 	}
 }
 
-func (s *Server) sock5(userConn *connection.SecureSocket) (dstConn *connection.SecureSocket, err error) {
-	_, err = connection.HandShakeHandler(userConn)
-	if err != nil {
-		return nil, errors.Trace(err)
+func (s *Server) setHandshakeDeadline(conn net.Conn) {
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
 	}
-	dst, _, err := connection.RequestHandler(userConn)
-	if err != nil {
-		return nil, errors.Trace(err)
+}
+
+func logError(err error) {
+	if connection.IsRecoverableNetError(err) {
+		// 例如 client 的健康检查, 握手后直接关闭连接
+		log.Debug(errors.Trace(err))
+	} else {
+		log.Error(errors.Trace(err))
 	}
-	log.Debugf("%s -> %s | %s -> %s", logger.ServerStr, logger.TargetStr, dst.LocalAddr(), dst.RemoteAddr())
-	dstConn = connection.NewSecureSocket(dst, s.cipher)
-	return dstConn, nil
 }
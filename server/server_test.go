@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/upstream"
+)
+
+// startEcho 启动一个回显目标
+func startEcho(t *testing.T) *connection.Addr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	addr, err := connection.NewAddr(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// startServer 在本地端口启动 srv, 返回连接 srv 的 Upstream 和 Serve 的返回值
+func startServer(t *testing.T, srv *Server, c cipher.Cipher) (*upstream.Upstream, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background(), l) }()
+	t.Cleanup(func() { srv.Close() })
+
+	u, err := upstream.New("test", l.Addr().String(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, served
+}
+
+func echo(conn net.Conn, msg string) error {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func testShutdownDrains(t *testing.T, muxConnections int) {
+	dst := startEcho(t)
+	c := cipher.NewByteMapCipher()
+	srv, err := New("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, served := startServer(t, srv, c)
+	u.MuxConnections = muxConnections
+
+	conn, err := u.Dial(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	if err := <-served; err != nil {
+		t.Fatalf("serve returned %v", err)
+	}
+
+	// 正在转发的隧道不受影响, 不能再建立新的隧道
+	if err := echo(conn, "during"); err != nil {
+		t.Fatal(err)
+	}
+	if newConn, err := u.Dial(context.Background(), dst); err == nil {
+		newConn.Close()
+		t.Fatal("dial succeeded after shutdown")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned %v with a tunnel in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not return after the tunnel was closed")
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	testShutdownDrains(t, 0)
+}
+
+func TestShutdownDrainsMux(t *testing.T) {
+	testShutdownDrains(t, 1)
+}
+
+// memListener 是内存中的 listener, 只用于检查 Serve 的返回
+type memListener struct {
+	closed chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *memListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return &net.UnixAddr{Name: "mem", Net: "mem"} }
+
+func TestServeReturnsAfterClose(t *testing.T) {
+	srv, err := New("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &memListener{closed: make(chan struct{})}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background(), l) }()
+
+	time.Sleep(10 * time.Millisecond)
+	srv.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve did not return after close")
+	}
+}
+
+// fakeDialer 记录连接的地址, 返回 net.Pipe 的一端, 另一端回显. err 不为 nil 时返回 err
+type fakeDialer struct {
+	mu    sync.Mutex
+	addrs []string
+	err   error
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+" "+address)
+	err := d.err
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		io.Copy(c2, c2)
+	}()
+	return c1, nil
+}
+
+func (d *fakeDialer) dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.addrs...)
+}
+
+func TestServerDialer(t *testing.T) {
+	c := cipher.NewByteMapCipher()
+	srv, err := New("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDialer{}
+	srv.Dialer = d
+	u, _ := startServer(t, srv, c)
+
+	// 目标不存在, 只有经过 Dialer 才能连接
+	dst, err := connection.NewAddr("fake.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := u.Dial(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.dialed(); len(got) != 1 || got[0] != "tcp fake.test:80" {
+		t.Fatalf("dialed %v", got)
+	}
+
+	// Dialer 失败时响应 host unreachable
+	d.mu.Lock()
+	d.err = io.ErrUnexpectedEOF
+	d.mu.Unlock()
+	if conn, err := u.Dial(context.Background(), dst); err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded with failing dialer")
+	}
+}
+
+// freePort 返回一个当前没有被占用的本地端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestReverseAllow(t *testing.T) {
+	c := cipher.NewByteMapCipher()
+	allowed, denied := freePort(t), freePort(t)
+	srv, err := New("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Reverse = true
+	srv.ReverseAllow = []string{"127.0.0.1:" + strconv.Itoa(allowed)}
+	u, _ := startServer(t, srv, c)
+
+	if l, err := u.ListenReverse(&connection.Addr{IP: net.IPv4(127, 0, 0, 1), Port: denied}); err == nil {
+		l.Close()
+		t.Fatal("reverse listen on a port not in ReverseAllow")
+	}
+
+	l, err := u.ListenReverse(&connection.Addr{IP: net.IPv4(127, 0, 0, 1), Port: allowed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(allowed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "reverse"); err != nil {
+		t.Fatal(err)
+	}
+
+	// listener 关闭后 Accept 返回 net.ErrClosed
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept after close: %v", err)
+	}
+}
+
+func TestReverseAllowed(t *testing.T) {
+	srv := &Server{ReverseAllow: []string{":8080", "127.0.0.1:9000", "[::1]:9000", "example.com:9001"}}
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"0.0.0.0:8080", true},
+		{"[::]:8080", true},
+		{"10.0.0.1:8080", true},
+		{"127.0.0.1:9000", true},
+		{"[::1]:9000", true},
+		{"0.0.0.0:9000", false},
+		{"EXAMPLE.com:9001", true},
+		{"127.0.0.1:9001", false},
+		{"127.0.0.1:22", false},
+	} {
+		addr, err := connection.NewAddr(tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.reverseAllowed(addr); got != tc.ok {
+			t.Errorf("reverseAllowed(%s) = %v, want %v", tc.addr, got, tc.ok)
+		}
+	}
+	if (&Server{}).reverseAllowed(&connection.Addr{IP: net.IPv4zero, Port: 8080}) {
+		t.Error("empty ReverseAllow allowed a reverse tunnel")
+	}
+}
+
+// waitClosed 等待 conn 被对端关闭, 最多等待 timeout
+func waitClosed(t *testing.T, conn net.Conn, timeout time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	_ = conn.SetReadDeadline(start.Add(timeout))
+	buf := make([]byte, 64)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("conn not closed after %s", timeout)
+			}
+			return time.Since(start)
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	srv, err := New("", cipher.NewByteMapCipher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.HandshakeTimeout = 100 * time.Millisecond
+	u, _ := startServer(t, srv, cipher.NewByteMapCipher())
+
+	// 连接后不发送 greeting
+	conn, err := net.Dial("tcp", u.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if d := waitClosed(t, conn, time.Second); d < 50*time.Millisecond {
+		t.Fatalf("closed after %s", d)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	dst := startEcho(t)
+	c := cipher.NewByteMapCipher()
+	srv, err := New("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.IdleTimeout = 200 * time.Millisecond
+	u, _ := startServer(t, srv, c)
+
+	conn, err := u.Dial(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 有数据时重新计时
+	for i := 0; i < 4; i++ {
+		if err := echo(conn, "hello"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if d := waitClosed(t, conn, time.Second); d < 50*time.Millisecond {
+		t.Fatalf("closed after %s", d)
+	}
+}
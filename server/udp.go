@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+// serveUDP 处理 UDP ASSOCIATE: 在隧道中收发 UDP 包, 每个隧道使用一个 UDP socket, 不经过 Dialer
+func (s *Server) serveUDP(userConn *connection.SecureSocket, first *connection.Addr) {
+	if !s.UDP {
+		_ = connection.ReplyRequest(userConn, connection.RepCommandNotSupported)
+		return
+	}
+	conn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		_ = connection.ReplyRequest(userConn, connection.RepGeneralFailure)
+		logError(err)
+		return
+	}
+	defer conn.Close()
+	if err := connection.ReplyRequest(userConn, connection.RepSucceeded); err != nil {
+		logError(err)
+		return
+	}
+	if err := userConn.SetDeadline(time.Time{}); err != nil {
+		logError(err)
+		return
+	}
+	log.Debugf("%s <-> %s | %s <-> %s udp relay, first packet to %s", logger.ClientStr, logger.ServerStr, userConn.RemoteAddr(), conn.LocalAddr(), first)
+
+	tunnel := connection.NewPlainConn(userConn)
+	watchdog := connection.NewWatchdog(s.UDPTimeout, s.MaxSessionDuration, func(reason string) {
+		log.Debugf("%s <-> %s | %s udp relay %s", logger.ClientStr, logger.ServerStr, userConn.RemoteAddr(), reason)
+		tunnel.Close()
+		conn.Close()
+	})
+	defer watchdog.Stop()
+
+	// target -> client, 只有这个 goroutine 写隧道
+	go func() {
+		defer tunnel.Close()
+		buf := make([]byte, connection.MaxUDPPacketSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			watchdog.Touch()
+			udpAddr, ok := from.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			if err := connection.WriteUDPPacket(tunnel, connection.UDPAddr(udpAddr), buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	// client -> target
+	buf := make([]byte, connection.MaxUDPPacketSize)
+	for {
+		addr, n, err := connection.ReadUDPPacket(tunnel, buf)
+		if err != nil {
+			// 隧道关闭或超时
+			log.Debugf("%s <-> %s | %s udp relay closed: %s", logger.ClientStr, logger.ServerStr, userConn.RemoteAddr(), err)
+			return
+		}
+		watchdog.Touch()
+		udpAddr, err := s.resolveUDPAddr(addr)
+		if err != nil {
+			log.Debugf("resolve %s err: %s", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(buf[:n], udpAddr); err != nil {
+			log.Debugf("udp write to %s err: %s", udpAddr, err)
+		}
+	}
+}
+
+func (s *Server) resolveUDPAddr(addr *connection.Addr) (*net.UDPAddr, error) {
+	if addr.IP != nil {
+		return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+	if s.Resolver == nil {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+		return udpAddr, errors.Trace(err)
+	}
+	ctx := context.Background()
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	ips, err := s.Resolver.LookupIP(ctx, addr.Host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no such host: %s", addr.Host)
+	}
+	return &net.UDPAddr{IP: ips[0], Port: addr.Port}, nil
+}
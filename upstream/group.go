@@ -0,0 +1,192 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/dns"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckInterval = 30 * time.Second
+	defaultCheckTimeout  = 5 * time.Second
+)
+
+// Group 是一组 Server, 由 Strategy 从可用的 Server 中选择一个, 连接失败时自动切换到其他 Server.
+// StartHealthCheck 后会定期检查每个 Server, 标记不可用的 Server.
+type Group struct {
+	Name      string
+	upstreams []*Upstream
+
+	// 默认为 Failover: 使用排在最前面的可用 Server
+	Strategy Strategy
+
+	CheckInterval time.Duration
+	CheckTimeout  time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func NewGroup(name string, upstreams ...*Upstream) *Group {
+	return &Group{
+		Name:          name,
+		upstreams:     upstreams,
+		Strategy:      &Failover{},
+		CheckInterval: defaultCheckInterval,
+		CheckTimeout:  defaultCheckTimeout,
+		stop:          make(chan struct{}),
+	}
+}
+
+func (g *Group) Upstreams() []*Upstream { return g.upstreams }
+
+// Dial 由 Strategy 选择可用的 Server, 连接失败时从剩下的 Server 中重新选择,
+// 都不可用时再尝试被标记为不可用的 Server. ctx 结束时放弃, 不标记 Server 不可用
+func (g *Group) Dial(ctx context.Context, dst *connection.Addr) (net.Conn, error) {
+	return g.dial(ctx, dst, (*Upstream).Dial)
+}
+
+// DialUDP 与 Dial 一样选择 Server, 在隧道中收发 UDP 包, 见 Upstream.DialUDP
+func (g *Group) DialUDP(ctx context.Context, dst *connection.Addr) (net.Conn, error) {
+	return g.dial(ctx, dst, (*Upstream).DialUDP)
+}
+
+func (g *Group) dial(
+	ctx context.Context, dst *connection.Addr,
+	dial func(u *Upstream, ctx context.Context, dst *connection.Addr) (net.Conn, error),
+) (net.Conn, error) {
+	if len(g.upstreams) == 0 {
+		return nil, fmt.Errorf("group %s has no upstream", g.Name)
+	}
+	var lastErr error
+	for _, alive := range []bool{true, false} {
+		var candidates []*Upstream
+		for _, u := range g.upstreams {
+			if u.Alive() == alive {
+				candidates = append(candidates, u)
+			}
+		}
+		for len(candidates) != 0 {
+			u := g.Strategy.Pick(candidates, dst)
+			conn, err := dial(u, ctx, dst)
+			if err == nil {
+				u.setAlive(true, nil)
+				return conn, nil
+			}
+			// 调用者放弃的连接不代表 Server 不可用
+			if dialer.Done(ctx) {
+				return nil, errors.Trace(err)
+			}
+			u.setAlive(false, err)
+			lastErr = err
+			candidates = remove(candidates, u)
+		}
+	}
+	return nil, errors.Annotatef(lastErr, "all upstreams of group %s failed", g.Name)
+}
+
+// ListenReverse 由 Strategy 选择一个 Server 请求监听 addr, 见 Upstream.ListenReverse.
+// 失败时由调用者重试, 不标记 Server 不可用, 因为 Server 可能只是拒绝了监听
+func (g *Group) ListenReverse(addr *connection.Addr) (net.Listener, error) {
+	if len(g.upstreams) == 0 {
+		return nil, fmt.Errorf("group %s has no upstream", g.Name)
+	}
+	var candidates []*Upstream
+	for _, u := range g.upstreams {
+		if u.Alive() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = g.upstreams
+	}
+	return g.Strategy.Pick(candidates, addr).ListenReverse(addr)
+}
+
+// DialContext 实现 dialer.Dialer, 只支持 tcp. tcp4/tcp6 时在本地解析域名, 只连接该地址族的 IP.
+// ctx 结束时放弃正在进行的连接
+func (g *Group) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+	address, err := dns.ResolveNetwork(ctx, nil, network, address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dst, err := connection.NewAddr(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := g.Dial(ctx, dst)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func remove(upstreams []*Upstream, u *Upstream) []*Upstream {
+	res := make([]*Upstream, 0, len(upstreams))
+	for _, item := range upstreams {
+		if item != u {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// StartHealthCheck 在后台定期检查所有 Server, 直到调用 Close
+func (g *Group) StartHealthCheck() {
+	go func() {
+		g.HealthCheck()
+		ticker := time.NewTicker(g.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.HealthCheck()
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+// HealthCheck 并发检查所有 Server 一次, Strategy 是 Prober 时再探测可用的 Server
+func (g *Group) HealthCheck() {
+	var wg sync.WaitGroup
+	for _, u := range g.upstreams {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			err := u.Check(g.CheckTimeout)
+			u.setAlive(err == nil, err)
+		}(u)
+	}
+	wg.Wait()
+
+	if prober, ok := g.Strategy.(Prober); ok {
+		var alive []*Upstream
+		for _, u := range g.upstreams {
+			if u.Alive() {
+				alive = append(alive, u)
+			}
+		}
+		prober.Probe(alive)
+	}
+}
+
+// Close 停止健康检查并关闭所有 Server 的连接池
+func (g *Group) Close() {
+	g.stopOnce.Do(func() { close(g.stop) })
+	for _, u := range g.upstreams {
+		u.Close()
+	}
+}
@@ -0,0 +1,162 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+)
+
+// startHangServer 启动一个接受连接后不响应握手的 Server, 返回 Server 一端的连接
+func startHangServer(t *testing.T) (string, <-chan net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			accepted <- conn
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+func TestGroupDialCanceled(t *testing.T) {
+	addr, accepted := startHangServer(t)
+	u, err := New("hang", addr, cipher.NewByteMapCipher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGroup("g", u)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if conn, err := g.Dial(ctx, &connection.Addr{Host: "example.com", Port: 80}); err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded")
+	}
+	// 不等到 DialTimeout
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("dial returned after %s", d)
+	}
+	if !u.Alive() {
+		t.Fatal("canceled dial marked the upstream down")
+	}
+
+	// 放弃的连接被关闭, 不在后台继续握手
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("server not dialed")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("abandoned connection still open")
+			}
+			break
+		}
+	}
+}
+
+func TestGroupDialContextNetwork(t *testing.T) {
+	g := NewGroup("g", startUpstream(t, "ok", 0))
+	if _, err := g.DialContext(context.Background(), "tcp6", "127.0.0.1:80"); err == nil {
+		t.Fatal("dialed an IPv4 address with tcp6")
+	}
+	if _, err := g.DialContext(context.Background(), "udp", "127.0.0.1:53"); err == nil {
+		t.Fatal("dialed udp")
+	}
+}
+
+// dialVia 通过 g 连接 dst, 返回连接期间活跃连接数增加的 Server
+func dialVia(t *testing.T, g *Group, dst *connection.Addr) *Upstream {
+	t.Helper()
+	conn, err := g.Dial(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, u := range g.Upstreams() {
+		if u.Conns() == 1 {
+			return u
+		}
+	}
+	t.Fatal("no upstream tracks the conn")
+	return nil
+}
+
+func TestGroupFailover(t *testing.T) {
+	dst := startBannerTarget(t)
+	c := cipher.NewByteMapCipher()
+	srv, addr := startServer(t, "127.0.0.1:0", c, 0)
+	first, err := New("first", addr, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := startUpstream(t, "second", 0)
+	g := NewGroup("g", first, second)
+
+	if got := dialVia(t, g, dst); got != first {
+		t.Fatalf("dialed via %s, want first", got)
+	}
+
+	srv.Close()
+	if got := dialVia(t, g, dst); got != second {
+		t.Fatalf("dialed via %s, want second", got)
+	}
+	if first.Alive() {
+		t.Fatal("stopped upstream still alive")
+	}
+	// 被标记为不可用后不再尝试
+	if got := dialVia(t, g, dst); got != second {
+		t.Fatalf("dialed via %s, want second", got)
+	}
+}
+
+func TestGroupHealthCheck(t *testing.T) {
+	dst := startBannerTarget(t)
+	c := cipher.NewByteMapCipher()
+	srv, addr := startServer(t, "127.0.0.1:0", c, 0)
+	first, err := New("first", addr, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := startUpstream(t, "second", 0)
+	g := NewGroup("g", first, second)
+	g.CheckTimeout = time.Second
+
+	srv.Close()
+	g.HealthCheck()
+	if first.Alive() || !second.Alive() {
+		t.Fatalf("alive after check: first %v, second %v", first.Alive(), second.Alive())
+	}
+	if got := dialVia(t, g, dst); got != second {
+		t.Fatalf("dialed via %s, want second", got)
+	}
+
+	// 同一个地址重新启动后, 健康检查恢复 Server
+	startServer(t, addr, c, 0)
+	g.HealthCheck()
+	if !first.Alive() {
+		t.Fatal("restarted upstream still down")
+	}
+	if got := dialVia(t, g, dst); got != first {
+		t.Fatalf("dialed via %s, want first", got)
+	}
+}
@@ -0,0 +1,144 @@
+package upstream
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	"github.com/obgnail/shadowsocks-toy/mux"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+var (
+	errMuxUnsupported = errors.New("server does not support mux")
+
+	muxGreeting = []byte{0x05, 0x02, connection.MethodNoAuth, connection.MethodMux}
+)
+
+// dialMux 在已有的 session 中打开 stream, 在 stream 上完成明文的 socks5 握手
+func (u *Upstream) dialMux(ctx context.Context, request []byte) (net.Conn, error) {
+	session, err := u.getSession(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	streamConn := connection.NewSecureSocket(stream, cipher.NewNopCipher())
+	err = dialer.Handshake(ctx, stream, func() error {
+		return connection.SendSocks5Data(streamConn, socks5Greeting, request)
+	})
+	if err != nil {
+		stream.Close()
+		return nil, errors.Trace(err)
+	}
+	return stream, nil
+}
+
+// getSession 不足 MuxConnections 个 session 时新建, 否则使用 stream 最少的 session.
+// 新建 session 需要建立连接并握手, 在锁外进行, 正在新建的 session 也计入 MuxConnections
+func (u *Upstream) getSession(ctx context.Context) (*mux.Session, error) {
+	u.muxMu.Lock()
+	for {
+		sessions := u.sessions[:0]
+		for _, session := range u.sessions {
+			if !session.IsClosed() {
+				sessions = append(sessions, session)
+			}
+		}
+		u.sessions = sessions
+
+		if len(u.sessions)+u.muxDialing < u.MuxConnections {
+			u.muxDialing++
+			u.muxMu.Unlock()
+			return u.dialSession(ctx)
+		}
+		if len(u.sessions) > 0 {
+			best := u.sessions[0]
+			for _, session := range u.sessions[1:] {
+				if session.NumStreams() < best.NumStreams() {
+					best = session
+				}
+			}
+			u.muxMu.Unlock()
+			return best, nil
+		}
+		// 所有 session 都在新建中, 等待其中一个完成
+		if u.muxDialed == nil {
+			u.muxDialed = make(chan struct{})
+		}
+		dialed := u.muxDialed
+		u.muxMu.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+		u.muxMu.Lock()
+	}
+}
+
+// dialSession 新建 session, 完成后唤醒等待的 getSession
+func (u *Upstream) dialSession(ctx context.Context) (*mux.Session, error) {
+	session, err := u.newSession(ctx)
+
+	u.muxMu.Lock()
+	defer u.muxMu.Unlock()
+	u.muxDialing--
+	if u.muxDialed != nil {
+		close(u.muxDialed)
+		u.muxDialed = nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	u.sessions = append(u.sessions, session)
+	return session, nil
+}
+
+// newSession 连接 Server 并协商多路复用, ctx 结束时放弃
+func (u *Upstream) newSession(ctx context.Context) (*mux.Session, error) {
+	conn, err := dialer.Direct.DialContext(ctx, "tcp", u.addr.String())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	serverConn := connection.NewSecureSocket(conn, u.cipher)
+	err = dialer.Handshake(ctx, conn, func() error {
+		if _, err := serverConn.EncryptFromBytes(muxGreeting); err != nil {
+			return errors.Trace(err)
+		}
+		buf := make([]byte, 2)
+		if err := serverConn.DecryptFull(buf); err != nil {
+			return errors.Trace(err)
+		}
+		if buf[0] != 0x05 || buf[1] != connection.MethodMux {
+			return errMuxUnsupported
+		}
+		return nil
+	})
+	if err != nil {
+		serverConn.Close()
+		return nil, errors.Trace(err)
+	}
+	log.Debugf("%s -> %s | %s -> %s mux session", logger.ClientStr, logger.ServerStr, conn.LocalAddr(), conn.RemoteAddr())
+	session, err := mux.Client(connection.NewPlainConn(serverConn), u.MuxConfig)
+	if err != nil {
+		serverConn.Close()
+		return nil, errors.Trace(err)
+	}
+	return session, nil
+}
+
+// closeSessions 关闭所有 session, 正在使用的 stream 也会被关闭
+func (u *Upstream) closeSessions() {
+	u.muxMu.Lock()
+	defer u.muxMu.Unlock()
+	for _, session := range u.sessions {
+		session.Close()
+	}
+	u.sessions = nil
+}
@@ -0,0 +1,107 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/obgnail/shadowsocks-toy/connection"
+)
+
+const banner = "SSH-2.0-test\r\n"
+
+// startBannerTarget 启动一个连接后先发送 banner 的目标, 类似 SSH/SMTP
+func startBannerTarget(t *testing.T) *connection.Addr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(banner))
+				// 回显 banner 之后的数据
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+	addr, err := connection.NewAddr(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// dialBanner 通过 u 连接 dst, 检查收到的 banner 和回显
+func dialBanner(u *Upstream, dst *connection.Addr) error {
+	conn, err := u.Dial(context.Background(), dst)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != banner {
+		return fmt.Errorf("banner %q, want %q", line, banner)
+	}
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		return err
+	}
+	if line, err = r.ReadString('\n'); err != nil {
+		return err
+	}
+	if line != "hello\n" {
+		return fmt.Errorf("echo %q", line)
+	}
+	return nil
+}
+
+func TestDialPreservesBanner(t *testing.T) {
+	dst := startBannerTarget(t)
+	u := startUpstream(t, "plain", 0)
+	for i := 0; i < 10; i++ {
+		if err := dialBanner(u, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDialMuxPreservesBanner(t *testing.T) {
+	dst := startBannerTarget(t)
+	u := startUpstream(t, "mux", 0)
+	u.MuxConnections = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := dialBanner(u, dst); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	u.muxMu.Lock()
+	defer u.muxMu.Unlock()
+	if len(u.sessions) > u.MuxConnections || u.muxDialing != 0 {
+		t.Fatalf("%d sessions, %d dialing", len(u.sessions), u.muxDialing)
+	}
+}
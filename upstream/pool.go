@@ -0,0 +1,188 @@
+package upstream
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolIdleTimeout = 5 * time.Minute
+	defaultPoolMaxAge      = 30 * time.Second
+
+	poolRefreshInterval = time.Second
+)
+
+// pool 在后台保持 PoolSize 个已经连接并完成 socks5 method 协商的空闲连接,
+// 使用时只需要发送 request, 省去建立连接和握手的 RTT.
+// Upstream.Start 或第一次使用时开始补充, Server 被标记为不可用时停止补充, stop 后不再补充.
+// 超过 PoolIdleTimeout 没有使用时关闭所有空闲连接并停止补充, 下次使用时重新开始
+type pool struct {
+	upstream *Upstream
+
+	mu       sync.Mutex
+	conns    []*pooledConn
+	lastUsed time.Time
+	running  bool
+	stopped  bool
+	// 每次 close 加一, 用于丢弃 close 之前开始建立的连接
+	gen int
+
+	wake chan struct{}
+}
+
+type pooledConn struct {
+	conn    *connection.SecureSocket
+	created time.Time
+}
+
+func newPool(u *Upstream) *pool {
+	return &pool{upstream: u, wake: make(chan struct{}, 1)}
+}
+
+// start 在后台开始补充连接
+func (p *pool) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastUsed = time.Now()
+	if !p.running && !p.stopped {
+		p.running = true
+		go p.run()
+	}
+}
+
+// get 返回一个空闲连接, 没有时返回 nil, 同时通知后台补充
+func (p *pool) get() *connection.SecureSocket {
+	p.mu.Lock()
+	p.lastUsed = time.Now()
+	var conn *connection.SecureSocket
+	for conn == nil && len(p.conns) != 0 {
+		pc := p.conns[0]
+		p.conns = p.conns[1:]
+		if p.expired(pc) {
+			pc.conn.Close()
+			continue
+		}
+		conn = pc.conn
+	}
+	if !p.running && !p.stopped {
+		p.running = true
+		go p.run()
+	}
+	p.mu.Unlock()
+
+	p.notify()
+	return conn
+}
+
+// notify 通知后台立即补充
+func (p *pool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pool) run() {
+	ticker := time.NewTicker(poolRefreshInterval)
+	defer ticker.Stop()
+	for p.refresh() {
+		select {
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// refresh 关闭过期的连接并补充到 PoolSize 个, 空闲超时, 没有开启连接池或已经 stop 时关闭所有连接并返回 false
+func (p *pool) refresh() bool {
+	p.mu.Lock()
+	if p.stopped || p.upstream.PoolSize <= 0 || time.Since(p.lastUsed) > p.upstream.PoolIdleTimeout {
+		for _, pc := range p.conns {
+			pc.conn.Close()
+		}
+		p.conns = nil
+		p.running = false
+		p.mu.Unlock()
+		return false
+	}
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if p.expired(pc) {
+			pc.conn.Close()
+		} else {
+			conns = append(conns, pc)
+		}
+	}
+	p.conns = conns
+	missing := p.upstream.PoolSize - len(p.conns)
+	gen := p.gen
+	p.mu.Unlock()
+
+	// 不可用的 Server 等健康检查或请求成功后再补充
+	for i := 0; i < missing && p.upstream.Alive(); i++ {
+		ctx, cancel := p.upstream.dialContext(context.Background())
+		conn, err := p.upstream.dialHandshake(ctx)
+		cancel()
+		if err != nil {
+			log.Debugf("%s %s fill pool err: %s", logger.ServerStr, p.upstream, err)
+			break
+		}
+		p.mu.Lock()
+		if p.gen != gen {
+			// 建立连接期间 Server 被标记为不可用
+			p.mu.Unlock()
+			conn.Close()
+			break
+		}
+		p.conns = append(p.conns, &pooledConn{conn: conn, created: time.Now()})
+		p.mu.Unlock()
+	}
+	return true
+}
+
+func (p *pool) expired(pc *pooledConn) bool {
+	return time.Since(pc.created) > p.upstream.PoolMaxAge
+}
+
+// close 关闭所有空闲连接, 正在建立的连接完成后也会被关闭
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gen++
+	for _, pc := range p.conns {
+		pc.conn.Close()
+	}
+	p.conns = nil
+}
+
+// stop 关闭所有空闲连接并停止补充
+func (p *pool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.close()
+	p.notify()
+}
+
+// dialHandshake 连接 Server 并完成 socks5 method 协商, ctx 结束时放弃
+func (u *Upstream) dialHandshake(ctx context.Context) (*connection.SecureSocket, error) {
+	conn, err := dialer.Direct.DialContext(ctx, "tcp", u.addr.String())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	serverConn := connection.NewSecureSocket(conn, u.cipher)
+	err = dialer.Handshake(ctx, conn, func() error {
+		return connection.SendHandshake(serverConn, socks5Greeting)
+	})
+	if err != nil {
+		serverConn.Close()
+		return nil, errors.Trace(err)
+	}
+	return serverConn, nil
+}
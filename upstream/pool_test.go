@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func poolLen(u *Upstream) int {
+	u.pool.mu.Lock()
+	defer u.pool.mu.Unlock()
+	return len(u.pool.conns)
+}
+
+func waitPoolLen(t *testing.T, u *Upstream, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * poolRefreshInterval)
+	for poolLen(u) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d conns, want %d", poolLen(u), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolPrewarm(t *testing.T) {
+	u := startUpstream(t, "pool", 0)
+	u.PoolSize = 2
+	// 没有请求也会预先建立连接
+	u.Start()
+	waitPoolLen(t, u, 2)
+
+	conn := u.pool.get()
+	if conn == nil {
+		t.Fatal("no pooled conn")
+	}
+	conn.Close()
+	waitPoolLen(t, u, 2)
+}
+
+func TestPoolStopsWhenDead(t *testing.T) {
+	u := startUpstream(t, "pool", 0)
+	u.PoolSize = 2
+	u.Start()
+	waitPoolLen(t, u, 2)
+
+	u.setAlive(false, nil)
+	if n := poolLen(u); n != 0 {
+		t.Fatalf("pool has %d conns after marked dead", n)
+	}
+	u.pool.refresh()
+	if n := poolLen(u); n != 0 {
+		t.Fatalf("pool refilled %d conns while dead", n)
+	}
+
+	u.setAlive(true, nil)
+	waitPoolLen(t, u, 2)
+}
+
+func poolRunning(u *Upstream) bool {
+	u.pool.mu.Lock()
+	defer u.pool.mu.Unlock()
+	return u.pool.running
+}
+
+func TestPoolDisabled(t *testing.T) {
+	u := startUpstream(t, "nopool", 0)
+	u.Start()
+	if poolRunning(u) {
+		t.Fatal("pool running without PoolSize")
+	}
+	if conn, err := u.Dial(context.Background(), startBannerTarget(t)); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+	if poolRunning(u) || poolLen(u) != 0 {
+		t.Fatal("pool running without PoolSize")
+	}
+}
+
+func TestPoolStartsOnFirstDial(t *testing.T) {
+	u := startUpstream(t, "pool", 0)
+	u.PoolSize = 2
+	if poolRunning(u) {
+		t.Fatal("pool running before Start")
+	}
+	conn, err := u.Dial(context.Background(), startBannerTarget(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitPoolLen(t, u, 2)
+}
+
+func TestPoolClose(t *testing.T) {
+	u := startUpstream(t, "pool", 0)
+	u.PoolSize = 2
+	u.Start()
+	waitPoolLen(t, u, 2)
+
+	u.Close()
+	if n := poolLen(u); n != 0 {
+		t.Fatalf("pool has %d conns after Close", n)
+	}
+	deadline := time.Now().Add(3 * poolRefreshInterval)
+	for poolRunning(u) {
+		if time.Now().After(deadline) {
+			t.Fatal("pool still running after Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Close 后请求不再使用和补充连接池
+	conn, err := u.Dial(context.Background(), startBannerTarget(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	time.Sleep(poolRefreshInterval + 100*time.Millisecond)
+	if poolRunning(u) || poolLen(u) != 0 {
+		t.Fatal("pool refilled after Close")
+	}
+}
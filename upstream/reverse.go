@@ -0,0 +1,82 @@
+package upstream
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/mux"
+	"net"
+	"time"
+)
+
+// ListenReverse 新建一个 mux session, 在 session 中请求 Server 监听 addr(反向隧道).
+// Server 接受的连接通过 Server 在 session 中打开的 stream 转发回来, 由返回的 Listener 接受.
+// 关闭 Listener 或 session 断开时 Server 停止监听, 之后 Accept 返回错误
+func (u *Upstream) ListenReverse(addr *connection.Addr) (net.Listener, error) {
+	ctx, cancel := u.dialContext(context.Background())
+	defer cancel()
+	session, err := u.newSession(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	control, err := session.Open()
+	if err != nil {
+		session.Close()
+		return nil, errors.Trace(err)
+	}
+	controlConn := connection.NewSecureSocket(control, cipher.NewNopCipher())
+	err = dialer.Handshake(ctx, control, func() error {
+		return connection.SendSocks5Data(controlConn, socks5Greeting, connection.NewBindRequest(addr))
+	})
+	if err != nil {
+		session.Close()
+		return nil, errors.Annotatef(err, "reverse listen %s", addr)
+	}
+	return &reverseListener{session: session, addr: addr, timeout: u.DialTimeout}, nil
+}
+
+type reverseListener struct {
+	session *mux.Session
+	addr    *connection.Addr
+	timeout time.Duration
+}
+
+// Accept 接受 Server 打开的 stream, stream 开头是连接在 Server 上的来源地址
+func (l *reverseListener) Accept() (net.Conn, error) {
+	for {
+		stream, err := l.session.Accept()
+		if err != nil {
+			// 与关闭的 net.Listener 一样返回 net.ErrClosed, 调用者用 errors.Is 判断, 同时保留 session 断开的原因
+			return nil, errors.Annotate(net.ErrClosed, err.Error())
+		}
+		_ = stream.SetReadDeadline(time.Now().Add(l.timeout))
+		src, err := connection.ReadAddr(stream)
+		if err != nil {
+			stream.Close()
+			continue
+		}
+		_ = stream.SetReadDeadline(time.Time{})
+		return &reverseConn{Stream: stream, remote: &net.TCPAddr{IP: src.IP, Port: src.Port}}, nil
+	}
+}
+
+func (l *reverseListener) Close() error { return l.session.Close() }
+
+func (l *reverseListener) Addr() net.Addr { return reverseAddr{l.addr} }
+
+// reverseAddr 是 Server 上监听的地址
+type reverseAddr struct {
+	*connection.Addr
+}
+
+func (reverseAddr) Network() string { return "tcp" }
+
+// reverseConn 的 RemoteAddr 是连接在 Server 上的来源地址
+type reverseConn struct {
+	*mux.Stream
+	remote net.Addr
+}
+
+func (c *reverseConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,136 @@
+package upstream
+
+import (
+	"fmt"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyFailover       = "failover"
+	StrategyRoundRobin     = "round-robin"
+	StrategyLeastConn      = "least-conn"
+	StrategyLatency        = "latency"
+	StrategyConsistentHash = "consistent-hash"
+	StrategyURLTest        = "url-test"
+)
+
+// Strategy 从可用的 Server 中选择一个, candidates 不为空
+type Strategy interface {
+	Pick(candidates []*Upstream, dst *connection.Addr) *Upstream
+}
+
+func NewStrategy(name string) (Strategy, error) {
+	switch strings.ToLower(name) {
+	case "", StrategyFailover:
+		return &Failover{}, nil
+	case StrategyRoundRobin:
+		return &RoundRobin{}, nil
+	case StrategyLeastConn:
+		return &LeastConn{}, nil
+	case StrategyLatency:
+		return &LatencyWeighted{}, nil
+	case StrategyConsistentHash:
+		return &ConsistentHash{}, nil
+	case StrategyURLTest:
+		return NewURLTest(defaultProbeURL, defaultTolerance), nil
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", name)
+	}
+}
+
+// Failover 总是选择排在最前面的 Server
+type Failover struct{}
+
+func (s *Failover) Pick(candidates []*Upstream, dst *connection.Addr) *Upstream {
+	return candidates[0]
+}
+
+type RoundRobin struct {
+	next uint64
+}
+
+func (s *RoundRobin) Pick(candidates []*Upstream, dst *connection.Addr) *Upstream {
+	idx := atomic.AddUint64(&s.next, 1) - 1
+	return candidates[idx%uint64(len(candidates))]
+}
+
+// LeastConn 选择当前活跃连接最少的 Server
+type LeastConn struct{}
+
+func (s *LeastConn) Pick(candidates []*Upstream, dst *connection.Addr) *Upstream {
+	best := candidates[0]
+	for _, u := range candidates[1:] {
+		if u.Conns() < best.Conns() {
+			best = u
+		}
+	}
+	return best
+}
+
+// LatencyWeighted 按健康检查测得的延迟加权随机选择, 权重为延迟的倒数.
+// 还没有测得延迟的 Server 按 defaultLatency 计算
+type LatencyWeighted struct{}
+
+const defaultLatency = time.Second
+
+// randFloat64 返回 [0, 1) 的随机数, 测试时替换
+var randFloat64 = rand.Float64
+
+func (s *LatencyWeighted) Pick(candidates []*Upstream, dst *connection.Addr) *Upstream {
+	weights := make([]float64, len(candidates))
+	var total float64
+	for idx, u := range candidates {
+		latency := u.Latency()
+		if latency <= 0 {
+			latency = defaultLatency
+		}
+		weights[idx] = 1 / latency.Seconds()
+		total += weights[idx]
+	}
+	r := randFloat64() * total
+	for idx, w := range weights {
+		if r < w {
+			return candidates[idx]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+// ConsistentHash 按目标地址做一致性哈希(rendezvous hashing), 同一个站点总是使用同一个 Server,
+// Server 不可用时只有原来分配到它的站点会迁移
+type ConsistentHash struct{}
+
+func (s *ConsistentHash) Pick(candidates []*Upstream, dst *connection.Addr) *Upstream {
+	key := dst.Host
+	if key == "" {
+		key = dst.IP.String()
+	}
+	var best *Upstream
+	var bestScore uint64
+	for _, u := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(u.Name))
+		if score := mix64(h.Sum64()); best == nil || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
+
+// mix64 是 murmur3 的 fmix64, fnv 对相近的 key 区分度不够
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/connection"
+)
+
+// newUpstreams 创建 n 个不连接的 Server, 名字为 u0, u1, ...
+func newUpstreams(t *testing.T, n int) []*Upstream {
+	t.Helper()
+	res := make([]*Upstream, n)
+	for i := range res {
+		u, err := New(fmt.Sprintf("u%d", i), fmt.Sprintf("127.0.0.1:%d", 10000+i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res[i] = u
+	}
+	return res
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{"", "Failover", StrategyRoundRobin, StrategyLeastConn,
+		StrategyLatency, StrategyConsistentHash, StrategyURLTest} {
+		if _, err := NewStrategy(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	if _, err := NewStrategy("random"); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ups := newUpstreams(t, 3)
+	s := &Failover{}
+	for i := 0; i < 3; i++ {
+		if got := s.Pick(ups, nil); got != ups[0] {
+			t.Fatalf("picked %s, want u0", got)
+		}
+	}
+	if got := s.Pick(ups[1:], nil); got != ups[1] {
+		t.Fatalf("picked %s, want u1", got)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	ups := newUpstreams(t, 3)
+	s := &RoundRobin{}
+	for i := 0; i < 7; i++ {
+		if got, want := s.Pick(ups, nil), ups[i%3]; got != want {
+			t.Fatalf("pick %d: %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	ups := newUpstreams(t, 3)
+	atomic.StoreInt64(&ups[0].conns, 3)
+	atomic.StoreInt64(&ups[1].conns, 1)
+	atomic.StoreInt64(&ups[2].conns, 2)
+	s := &LeastConn{}
+	if got := s.Pick(ups, nil); got != ups[1] {
+		t.Fatalf("picked %s, want u1", got)
+	}
+	// 相同时选择排在前面的
+	atomic.StoreInt64(&ups[2].conns, 1)
+	if got := s.Pick(ups, nil); got != ups[1] {
+		t.Fatalf("picked %s, want u1", got)
+	}
+	atomic.StoreInt64(&ups[0].conns, 0)
+	if got := s.Pick(ups, nil); got != ups[0] {
+		t.Fatalf("picked %s, want u0", got)
+	}
+}
+
+func TestLatencyWeighted(t *testing.T) {
+	ups := newUpstreams(t, 3)
+	// 权重 10, 5, 1(没有测得延迟)
+	atomic.StoreInt64(&ups[0].latency, int64(100*time.Millisecond))
+	atomic.StoreInt64(&ups[1].latency, int64(200*time.Millisecond))
+
+	var r float64
+	defer func(f func() float64) { randFloat64 = f }(randFloat64)
+	randFloat64 = func() float64 { return r }
+
+	for _, tc := range []struct {
+		r    float64
+		want *Upstream
+	}{
+		{0, ups[0]},
+		{9.9 / 16, ups[0]},
+		{10.1 / 16, ups[1]},
+		{14.9 / 16, ups[1]},
+		{15.1 / 16, ups[2]},
+		{0.999, ups[2]},
+	} {
+		r = tc.r
+		if got := (&LatencyWeighted{}).Pick(ups, nil); got != tc.want {
+			t.Errorf("r=%v: picked %s, want %s", tc.r, got, tc.want)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	ups := newUpstreams(t, 3)
+	s := &ConsistentHash{}
+
+	dsts := make([]*connection.Addr, 100)
+	picked := make(map[*connection.Addr]*Upstream)
+	used := make(map[*Upstream]int)
+	for i := range dsts {
+		dsts[i] = &connection.Addr{Host: fmt.Sprintf("site%d.example.com", i), Port: 443}
+		picked[dsts[i]] = s.Pick(ups, dsts[i])
+		used[picked[dsts[i]]]++
+	}
+	if len(used) != len(ups) {
+		t.Fatalf("only %d upstreams used: %v", len(used), used)
+	}
+
+	// 同一个站点总是使用同一个 Server, 与端口和 candidates 的顺序无关
+	reversed := []*Upstream{ups[2], ups[1], ups[0]}
+	for _, dst := range dsts {
+		other := &connection.Addr{Host: dst.Host, Port: 80}
+		if got := s.Pick(reversed, other); got != picked[dst] {
+			t.Fatalf("%s: picked %s, want %s", dst.Host, got, picked[dst])
+		}
+	}
+
+	// 没有域名时按 IP
+	ip := &connection.Addr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	if s.Pick(ups, ip) != s.Pick(reversed, ip) {
+		t.Fatal("ip dst not sticky")
+	}
+
+	// 去掉一个 Server 时只有分配到它的站点迁移
+	for _, dst := range dsts {
+		got := s.Pick(ups[:2], dst)
+		if picked[dst] != ups[2] && got != picked[dst] {
+			t.Fatalf("%s moved from %s to %s", dst.Host, picked[dst], got)
+		}
+	}
+}
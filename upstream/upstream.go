@@ -0,0 +1,231 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	"github.com/obgnail/shadowsocks-toy/mux"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDialTimeout = 5 * time.Second
+
+var socks5Greeting = []byte{0x05, 0x01, 0x00}
+
+// Upstream 是一个 Server, 每个 Server 有自己的 cipher
+type Upstream struct {
+	Name   string
+	cipher cipher.Cipher
+	addr   *net.TCPAddr
+
+	DialTimeout time.Duration
+
+	// MuxConnections > 0 时通过多路复用连接 Server, 最多建立 MuxConnections 个长连接,
+	// Server 不支持时退回到每个请求一个连接
+	MuxConnections int
+	MuxConfig      *mux.Config
+
+	muxMu          sync.Mutex
+	sessions       []*mux.Session
+	muxDialing     int
+	muxDialed      chan struct{}
+	muxUnsupported int32
+
+	// PoolSize > 0 时在后台保持 PoolSize 个已经完成握手的空闲连接, 省去每个请求建立连接的 RTT.
+	// Start 或第一次请求后开始补充, Server 不可用时停止补充, Close 后不再补充.
+	// 超过 PoolIdleTimeout 没有使用时关闭空闲连接并停止补充, 空闲连接最多保留 PoolMaxAge,
+	// PoolMaxAge 应该小于 Server 的握手超时
+	PoolSize        int
+	PoolIdleTimeout time.Duration
+	PoolMaxAge      time.Duration
+	pool            *pool
+
+	alive   int32
+	conns   int64
+	latency int64 // 最近一次健康检查的延迟, 单位 ns
+}
+
+func New(name, addr string, c cipher.Cipher) (*Upstream, error) {
+	if c == nil {
+		c = &cipher.NopCipher{}
+	}
+	rAddr, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = addr
+	}
+	u := &Upstream{
+		Name:            name,
+		cipher:          c,
+		addr:            rAddr,
+		DialTimeout:     defaultDialTimeout,
+		PoolIdleTimeout: defaultPoolIdleTimeout,
+		PoolMaxAge:      defaultPoolMaxAge,
+		alive:           1,
+	}
+	u.pool = newPool(u)
+	return u, nil
+}
+
+// Start 在 PoolSize > 0 时开始预先建立连接, 不调用时在第一次请求后开始
+func (u *Upstream) Start() {
+	if u.PoolSize > 0 {
+		u.pool.start()
+	}
+}
+
+// Close 关闭连接池中的空闲连接并停止补充, 不影响正在使用的连接
+func (u *Upstream) Close() {
+	u.pool.stop()
+}
+
+func (u *Upstream) Addr() *net.TCPAddr { return u.addr }
+
+func (u *Upstream) Alive() bool { return atomic.LoadInt32(&u.alive) == 1 }
+
+// Conns 返回当前通过该 Server 的活跃连接数
+func (u *Upstream) Conns() int64 { return atomic.LoadInt64(&u.conns) }
+
+// Latency 返回最近一次健康检查的延迟, 没有检查过时为 0
+func (u *Upstream) Latency() time.Duration { return time.Duration(atomic.LoadInt64(&u.latency)) }
+
+// setAlive 更新状态, 状态变化时打印日志
+func (u *Upstream) setAlive(alive bool, reason error) {
+	var v int32
+	if alive {
+		v = 1
+	}
+	if atomic.SwapInt32(&u.alive, v) == v {
+		return
+	}
+	if alive {
+		log.Infof("%s %s is up", logger.ServerStr, u)
+		u.pool.notify()
+	} else {
+		log.Warnf("%s %s is down: %s", logger.ServerStr, u, reason)
+		u.closeSessions()
+		u.pool.close()
+	}
+}
+
+// Dial 连接 Server 并完成 socks5 握手, 返回的连接读写的都是明文.
+// 连接和握手最多用 DialTimeout, ctx 结束时放弃
+func (u *Upstream) Dial(ctx context.Context, dst *connection.Addr) (net.Conn, error) {
+	return u.track(u.dial(ctx, connection.NewRequest(dst)))
+}
+
+// DialUDP 连接 Server 并发送 UDP ASSOCIATE, 之后用 connection.WriteUDPPacket/ReadUDPPacket 收发 UDP 包.
+// dst 是第一个包的目标
+func (u *Upstream) DialUDP(ctx context.Context, dst *connection.Addr) (net.Conn, error) {
+	return u.track(u.dial(ctx, connection.NewUDPRequest(dst)))
+}
+
+func (u *Upstream) track(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	atomic.AddInt64(&u.conns, 1)
+	return &trackedConn{Conn: conn, upstream: u}, nil
+}
+
+func (u *Upstream) dial(ctx context.Context, request []byte) (net.Conn, error) {
+	ctx, cancel := u.dialContext(ctx)
+	defer cancel()
+	if u.MuxConnections > 0 && atomic.LoadInt32(&u.muxUnsupported) == 0 {
+		conn, err := u.dialMux(ctx, request)
+		if errors.Cause(err) != errMuxUnsupported {
+			return conn, errors.Trace(err)
+		}
+		if atomic.CompareAndSwapInt32(&u.muxUnsupported, 0, 1) {
+			log.Warnf("%s %s does not support mux, fallback to one connection per request", logger.ServerStr, u)
+		}
+	}
+
+	if u.PoolSize > 0 {
+		if serverConn := u.pool.get(); serverConn != nil {
+			err := u.sendRequest(ctx, serverConn, request)
+			if err == nil {
+				return connection.NewPlainConn(serverConn), nil
+			}
+			// 空闲连接可能已经被 Server 关闭, 重新建立连接
+			log.Debugf("%s %s pooled conn err: %s", logger.ServerStr, u, err)
+			serverConn.Close()
+		}
+	}
+
+	serverConn, err := u.dialHandshake(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := u.sendRequest(ctx, serverConn, request); err != nil {
+		serverConn.Close()
+		return nil, errors.Trace(err)
+	}
+	return connection.NewPlainConn(serverConn), nil
+}
+
+// dialContext 给 ctx 加上 DialTimeout, DialTimeout 为 0 时不限制
+func (u *Upstream) dialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if u.DialTimeout > 0 {
+		return context.WithTimeout(ctx, u.DialTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// sendRequest 发送 request 并等待 Server 响应, ctx 结束时中断
+func (u *Upstream) sendRequest(ctx context.Context, serverConn *connection.SecureSocket, request []byte) error {
+	return errors.Trace(dialer.Handshake(ctx, serverConn, func() error {
+		return connection.SendRequest(serverConn, request)
+	}))
+}
+
+// Check 连接 Server 并完成 socks5 握手的 method 协商, 用于健康检查, 成功时记录延迟
+func (u *Upstream) Check(timeout time.Duration) error {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", u.addr.String(), timeout)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return errors.Trace(err)
+	}
+	if err := connection.SendHandshake(connection.NewSecureSocket(conn, u.cipher), socks5Greeting); err != nil {
+		return errors.Trace(err)
+	}
+	atomic.StoreInt64(&u.latency, int64(time.Since(start)))
+	return nil
+}
+
+func (u *Upstream) String() string {
+	if u.Name == u.addr.String() {
+		return u.Name
+	}
+	return fmt.Sprintf("%s(%s)", u.Name, u.addr)
+}
+
+// trackedConn 关闭时减少 Upstream 的活跃连接数
+type trackedConn struct {
+	net.Conn
+	upstream  *Upstream
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return connection.CloseWrite(c.Conn)
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddInt64(&c.upstream.conns, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/shadowsocks-toy/connection"
+	"github.com/obgnail/shadowsocks-toy/logger"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeURL     = "http://www.gstatic.com/generate_204"
+	defaultProbeTimeout = 5 * time.Second
+	defaultTolerance    = 50 * time.Millisecond
+)
+
+var _ Prober = (*URLTest)(nil)
+
+// Prober 是需要定期探测 Server 的 Strategy, Group 做完健康检查后用可用的 Server 调用 Probe
+type Prober interface {
+	Probe(upstreams []*Upstream)
+}
+
+type ProbeResult struct {
+	Upstream string
+	Delay    time.Duration // 连接 + 首字节的延迟, 失败时为 0
+	Err      error
+}
+
+// URLTest 通过每个 Server 请求 URL, 测量连接 + 首字节的延迟, 选择最快的 Server.
+// 新的最快 Server 比当前 Server 快超过 Tolerance 时才切换, 避免来回切换
+type URLTest struct {
+	URL       string
+	Timeout   time.Duration
+	Tolerance time.Duration
+
+	mu         sync.RWMutex
+	selected   *Upstream
+	results    []*ProbeResult
+	byUpstream map[*Upstream]*ProbeResult
+}
+
+func NewURLTest(url string, tolerance time.Duration) *URLTest {
+	if url == "" {
+		url = defaultProbeURL
+	}
+	return &URLTest{URL: url, Timeout: defaultProbeTimeout, Tolerance: tolerance}
+}
+
+// Pick 使用当前选中的 Server, 它不可用或还没有探测过时使用探测结果最快的 Server
+func (s *URLTest) Pick(candidates []*Upstream, dst *connection.Addr) *Upstream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var fastest *Upstream
+	for _, u := range candidates {
+		if u == s.selected {
+			return u
+		}
+		if r := s.byUpstream[u]; r != nil && r.Err == nil {
+			if fastest == nil || r.Delay < s.byUpstream[fastest].Delay {
+				fastest = u
+			}
+		}
+	}
+	if fastest != nil {
+		return fastest
+	}
+	return candidates[0]
+}
+
+func (s *URLTest) Probe(upstreams []*Upstream) {
+	results := make([]*ProbeResult, len(upstreams))
+	var wg sync.WaitGroup
+	for idx, u := range upstreams {
+		wg.Add(1)
+		go func(idx int, u *Upstream) {
+			defer wg.Done()
+			delay, err := s.measure(u)
+			results[idx] = &ProbeResult{Upstream: u.Name, Delay: delay, Err: err}
+			if err != nil {
+				log.Warnf("%s %s url-test %s err: %s", logger.ServerStr, u, s.URL, err)
+			} else {
+				log.Debugf("%s %s url-test %s delay: %s", logger.ServerStr, u, s.URL, delay)
+			}
+		}(idx, u)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = results
+	s.byUpstream = make(map[*Upstream]*ProbeResult, len(upstreams))
+	var fastest *Upstream
+	for idx, u := range upstreams {
+		r := results[idx]
+		s.byUpstream[u] = r
+		if r.Err == nil && (fastest == nil || r.Delay < s.byUpstream[fastest].Delay) {
+			fastest = u
+		}
+	}
+	if fastest == nil || fastest == s.selected {
+		return
+	}
+	if current := s.byUpstream[s.selected]; current != nil && current.Err == nil &&
+		current.Delay <= s.byUpstream[fastest].Delay+s.Tolerance {
+		return
+	}
+	if s.selected == nil {
+		log.Infof("url-test select %s (%s)", fastest, s.byUpstream[fastest].Delay)
+	} else {
+		log.Infof("url-test switch %s -> %s (%s)", s.selected, fastest, s.byUpstream[fastest].Delay)
+	}
+	s.selected = fastest
+}
+
+// measure 通过 Server 请求 URL, 返回收到响应头的耗时
+func (s *URLTest) measure(u *Upstream) (time.Duration, error) {
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dst, err := connection.NewAddr(addr)
+			if err != nil {
+				return nil, err
+			}
+			return u.Dial(ctx, dst)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: transport, Timeout: s.Timeout}
+
+	start := time.Now()
+	resp, err := httpClient.Get(s.URL)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	delay := time.Since(start)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return 0, fmt.Errorf("bad status: %s", resp.Status)
+	}
+	return delay, nil
+}
+
+// Selected 返回当前选中的 Server, 还没有探测过时为 nil
+func (s *URLTest) Selected() *Upstream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.selected
+}
+
+// Results 按 Server 顺序返回最近一次探测的结果
+func (s *URLTest) Results() []ProbeResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results := make([]ProbeResult, len(s.results))
+	for idx, r := range s.results {
+		results[idx] = *r
+	}
+	return results
+}
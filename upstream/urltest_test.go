@@ -0,0 +1,122 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/obgnail/shadowsocks-toy/cipher"
+	"github.com/obgnail/shadowsocks-toy/dialer"
+	"github.com/obgnail/shadowsocks-toy/server"
+)
+
+// startUpstream 启动一个本地 Server, Server 连接目标前等待 delay
+func startUpstream(t *testing.T, name string, delay time.Duration) *Upstream {
+	t.Helper()
+	c := cipher.NewByteMapCipher()
+	_, addr := startServer(t, "127.0.0.1:0", c, delay)
+	u, err := New(name, addr, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// startServer 在 addr 上启动一个 Server, 返回 Server 和监听的地址
+func startServer(t *testing.T, addr string, c cipher.Cipher, delay time.Duration) (*server.Server, string) {
+	t.Helper()
+	srv, err := server.New("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Dialer = dialer.Func(func(ctx context.Context, network, address string) (net.Conn, error) {
+		time.Sleep(delay)
+		return dialer.Direct.DialContext(ctx, network, address)
+	})
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), l)
+	t.Cleanup(func() { srv.Close() })
+	return srv, l.Addr().String()
+}
+
+func newProbeTarget(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestURLTestSelectsFastest(t *testing.T) {
+	ts := newProbeTarget(t)
+	slow := startUpstream(t, "slow", 200*time.Millisecond)
+	fast := startUpstream(t, "fast", 0)
+
+	s := NewURLTest(ts.URL, 50*time.Millisecond)
+	s.Probe([]*Upstream{slow, fast})
+	if got := s.Selected(); got != fast {
+		t.Fatalf("selected %v, want fast", got)
+	}
+	if got := s.Pick([]*Upstream{slow, fast}, nil); got != fast {
+		t.Fatalf("picked %v, want fast", got)
+	}
+	// 选中的 Server 不可用时使用其他探测成功的 Server
+	if got := s.Pick([]*Upstream{slow}, nil); got != slow {
+		t.Fatalf("picked %v, want slow", got)
+	}
+	for _, r := range s.Results() {
+		if r.Err != nil {
+			t.Fatalf("probe %s: %v", r.Upstream, r.Err)
+		}
+	}
+}
+
+func TestURLTestTolerance(t *testing.T) {
+	ts := newProbeTarget(t)
+	slow := startUpstream(t, "slow", 100*time.Millisecond)
+	fast := startUpstream(t, "fast", 0)
+
+	s := NewURLTest(ts.URL, time.Second)
+	s.Probe([]*Upstream{slow})
+	if got := s.Selected(); got != slow {
+		t.Fatalf("selected %v, want slow", got)
+	}
+	// 快的 Server 没有快过 Tolerance, 不切换
+	s.Probe([]*Upstream{slow, fast})
+	if got := s.Selected(); got != slow {
+		t.Fatalf("switched to %v within tolerance", got)
+	}
+
+	s.Tolerance = 10 * time.Millisecond
+	s.Probe([]*Upstream{slow, fast})
+	if got := s.Selected(); got != fast {
+		t.Fatalf("selected %v, want fast", got)
+	}
+}
+
+func TestURLTestProbeFailure(t *testing.T) {
+	ts := newProbeTarget(t)
+	u := startUpstream(t, "ok", 0)
+
+	s := NewURLTest(ts.URL, defaultTolerance)
+	s.Timeout = time.Second
+	// 关闭的 Server
+	dead, err := New("dead", "127.0.0.1:1", cipher.NewByteMapCipher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Probe([]*Upstream{dead, u})
+	if got := s.Selected(); got != u {
+		t.Fatalf("selected %v, want ok", got)
+	}
+	if r := s.Results()[0]; r.Err == nil {
+		t.Fatal("probe through dead upstream succeeded")
+	}
+}